@@ -1,163 +1,4287 @@
 package handler
 
 import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
 	"io"
+	"log/slog"
+	"math"
+	mathrand "math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
 
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/redis/go-redis/v9"
+	"github.com/yuin/goldmark"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/image/draw"
+	"golang.org/x/text/unicode/norm"
 	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+	htransport "google.golang.org/api/transport/http"
+	"gopkg.in/yaml.v3"
 )
 
 type Item struct {
-	Title       string   `json:"title"`
-	Subtitle    string   `json:"subtitle"`
-	Description string   `json:"description"`
-	Code        string   `json:"code"`
-	ImageURLs   []string `json:"imageUrls"`
-	VideoURLs   []string `json:"videoUrls"`
+	Title           string            `json:"title"`
+	Slug            string            `json:"slug"`
+	Subtitle        string            `json:"subtitle"`
+	Description     string            `json:"description"`
+	DescriptionHTML string            `json:"descriptionHtml,omitempty"`
+	Code            string            `json:"code"`
+	CoverURL        string            `json:"coverUrl"`
+	ImageURLs       []string          `json:"imageUrls"`
+	Thumbnails      []string          `json:"thumbnails"`
+	Images          []Image           `json:"images"`
+	VideoURLs       []string          `json:"videoUrls"`
+	Videos          []Video           `json:"videos"`
+	AudioURLs       []string          `json:"audioUrls"`
+	Documents       []string          `json:"documents"`
+	Price           float64           `json:"price,omitempty"`
+	Currency        string            `json:"currency,omitempty"`
+	Tags            []string          `json:"tags,omitempty"`
+	Status          string            `json:"status,omitempty"`
+	Featured        bool              `json:"featured"`
+	Category        string            `json:"category,omitempty"`
+	Lang            string            `json:"lang,omitempty"`
+	CreatedAt       string            `json:"createdAt,omitempty"`
+	UpdatedAt       string            `json:"updatedAt,omitempty"`
+	Links           map[string]string `json:"links,omitempty"`
+	Extra           map[string]string `json:"extra,omitempty"`
+	Warnings        []string          `json:"warnings,omitempty"`
+
+	// invalid marca los items a los que les falta algún campo obligatorio
+	invalid bool
+}
+
+// Image describe cada imagen de la galería con datos para mostrarla
+type Image struct {
+	URL       string `json:"url"`
+	Filename  string `json:"filename"`
+	Alt       string `json:"alt"`
+	Width     int64  `json:"width,omitempty"`
+	Height    int64  `json:"height,omitempty"`
+	SizeBytes int64  `json:"sizeBytes,omitempty"`
+	// Rotation son los grados (0, 90, 180 o 270, en sentido horario) que hay
+	// que rotar la imagen para verla derecha
+	Rotation int64 `json:"rotation,omitempty"`
+	// AspectRatio es el ancho dividido el alto de la imagen ya rotada
+	AspectRatio float64 `json:"aspectRatio,omitempty"`
+	// BlurDataURL es una miniatura diminuta como data URI, para mostrar
+	// desenfocada mientras carga la imagen (solo con blurPreview=true)
+	BlurDataURL string `json:"blurDataUrl,omitempty"`
+}
+
+// Video acompaña cada URL de video con su imagen de portada, si Drive la tiene
+type Video struct {
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnailUrl,omitempty"`
+}
+
+type Response struct {
+	Items         []Item   `json:"items"`
+	Total         int      `json:"total"`
+	NextPageToken string   `json:"nextPageToken,omitempty"`
+	Truncated     bool     `json:"truncated,omitempty"`
+	Meta          *Meta    `json:"meta,omitempty"`
+	Warnings      []string `json:"warnings,omitempty"`
+	Error         string   `json:"error,omitempty"`
+	ErrorCode     string   `json:"errorCode,omitempty"`
+	RequestID     string   `json:"requestId,omitempty"`
+}
+
+// Meta son los datos generales de la galería, leídos del archivo de metadata
+// que está directamente en la carpeta raíz
+type Meta struct {
+	Title       string            `json:"title,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Extra       map[string]string `json:"extra,omitempty"`
+}
+
+// folderMimeType es el tipo MIME que Drive usa para las carpetas
+const folderMimeType = "application/vnd.google-apps.folder"
+
+// itemFileFieldList son los campos que se piden de cada archivo de un item
+const itemFileFieldList = "id, name, mimeType, size, webContentLink, webViewLink, thumbnailLink, imageMediaMetadata(width, height, rotation), shortcutDetails(targetId, targetMimeType)"
+
+// itemFileFields son los mismos campos para un Files.List
+const itemFileFields = "files(" + itemFileFieldList + ")"
+
+// shortcutMimeType es el tipo MIME que Drive usa para los accesos directos
+const shortcutMimeType = "application/vnd.google-apps.shortcut"
+
+// googleDocMimeType es el tipo MIME de los documentos nativos de Google Docs
+const googleDocMimeType = "application/vnd.google-apps.document"
+
+// maxPageLimit es el máximo de items que se devuelven por página
+const maxPageLimit = 100
+
+// maxDrivePageSize es el máximo de archivos que Drive devuelve por página
+const maxDrivePageSize = 1000
+
+// logger escribe logs en JSON a stdout para poder filtrarlos en Vercel.
+// LOG_LEVEL (debug, info, warn, error) define el nivel mínimo; por defecto info.
+var logger = newLogger(os.Getenv("LOG_LEVEL"))
+
+func newLogger(level string) *slog.Logger {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		lvl = slog.LevelInfo
+	}
+	return slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: lvl}))
+}
+
+// requestIDKey guarda en el contexto el X-Request-ID de la petición
+type requestIDKey struct{}
+
+// requestIDFrom devuelve el X-Request-ID guardado en el contexto, o ""
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// loggerFrom devuelve el logger con el X-Request-ID de la petición, para
+// poder seguir en los logs todo lo que pasó en ella.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if id := requestIDFrom(ctx); id != "" {
+		return logger.With("requestId", id)
+	}
+	return logger
+}
+
+// incomingRequestID acepta el X-Request-ID del cliente si es razonable
+// (hasta 128 caracteres visibles); si no, devuelve "".
+func incomingRequestID(id string) string {
+	if id == "" || len(id) > 128 {
+		return ""
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return ""
+		}
+	}
+	return id
+}
+
+// newRequestID genera un ID aleatorio de 32 caracteres hexadecimales
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+// tracer crea los spans de las llamadas a Drive. Mientras no haya un exporter
+// configurado usa el proveedor global de OpenTelemetry, que no hace nada.
+var tracer = otel.Tracer("page-backend")
+
+var (
+	tracingOnce sync.Once
+	tracing     *sdktrace.TracerProvider
+)
+
+// tracerProvider configura, la primera vez, el envío de trazas por OTLP/HTTP
+// si OTEL_EXPORTER_OTLP_ENDPOINT (o su variante _TRACES_) está definida.
+// Devuelve nil si el tracing está desactivado.
+func tracerProvider() *sdktrace.TracerProvider {
+	tracingOnce.Do(func() {
+		if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+			return
+		}
+		// El exporter lee el endpoint y los headers de las variables OTEL_* estándar
+		exporter, err := otlptracehttp.New(context.Background())
+		if err != nil {
+			logger.Error("unable to create trace exporter", "error", err.Error())
+			return
+		}
+		tracing = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+		otel.SetTracerProvider(tracing)
+	})
+	return tracing
+}
+
+// endSpan registra el error (si hay) y cierra el span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Handler es la función principal que maneja las peticiones en Vercel
+func Handler(w http.ResponseWriter, r *http.Request) {
+	// Enviar las trazas de la petición antes de que Vercel congele la función
+	if provider := tracerProvider(); provider != nil {
+		defer provider.ForceFlush(context.Background())
+	}
+
+	// Identificar la petición en los logs y en los errores devueltos
+	requestID := incomingRequestID(r.Header.Get("X-Request-ID"))
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	w.Header().Set("X-Request-ID", requestID)
+	r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, requestID))
+
+	metrics.requests.Add(1)
+	sw := &statusWriter{ResponseWriter: w}
+	defer func() {
+		if sw.status >= 500 {
+			metrics.errors.Add(1)
+		}
+	}()
+	w = sw
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", allowedOrigin(r, w))
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key, X-Debug-Token, X-Metrics-Token, X-Request-ID")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Limitar la cantidad de peticiones por IP para cuidar la cuota de Drive
+	if ok, retryAfter := rateLimiter.allow(clientIP(r), time.Now()); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "Too many requests"})
+		return
+	}
+
+	// Las notificaciones push de Drive se validan con el token del canal, no con API_KEY
+	if r.Method == http.MethodPost && r.Header.Get("X-Goog-Resource-State") != "" {
+		serveWebhook(w, r)
+		return
+	}
+
+	// Si API_KEY está configurada, exigirla en el header X-API-Key
+	if apiKey := os.Getenv("API_KEY"); apiKey != "" {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-API-Key")), []byte(apiKey)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "Invalid or missing API key"})
+			return
+		}
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "Method not allowed"})
+		return
+	}
+
+	// Modo métricas: contadores del contenedor, protegidos por token
+	if r.URL.Query().Get("metrics") != "" {
+		serveMetrics(w, r)
+		return
+	}
+
+	// HEAD se resuelve igual que GET pero sin enviar el cuerpo
+	if r.Method == http.MethodHead {
+		w = headResponseWriter{w}
+	}
+
+	// Obtener el ID de la carpeta raíz desde variables de entorno o query params
+	rootFolderID, err := resolveRootFolder(r.Context(), r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: err.Error()})
+		return
+	}
+
+	// Los IDs se interpolan en las consultas a Drive: aceptar solo IDs válidos
+	for _, param := range []string{"driveId", "debug", "validate", "zip"} {
+		if value := r.URL.Query().Get(param); value != "" && !isDriveID(value) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: param + " must be a valid Drive ID"})
+			return
+		}
+	}
+
+	// Obtener credenciales desde variable de entorno
+	credentialsJSON := os.Getenv("GOOGLE_CREDENTIALS_JSON")
+
+	// Modo health: validar credenciales y acceso a la carpeta raíz sin leer items
+	if r.URL.Query().Get("health") != "" {
+		serveHealth(w, r, credentialsJSON, rootFolderID)
+		return
+	}
+
+	if rootFolderID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "Folder ID is required"})
+		return
+	}
+
+	if credentialsJSON == "" {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "Google credentials not configured"})
+		return
+	}
+
+	// Modo proxy: devolver el contenido de un archivo sin que tenga que ser público
+	if fileID := r.URL.Query().Get("proxy"); fileID != "" {
+		serveProxy(w, r, credentialsJSON, rootFolderID, fileID)
+		return
+	}
+
+	// Modo debug: listado crudo de los archivos de una carpeta, protegido por token
+	if folderID := r.URL.Query().Get("debug"); folderID != "" {
+		serveDebug(w, r, credentialsJSON, folderID)
+		return
+	}
+
+	// Modo validación: revisar la estructura de una carpeta de item antes de publicarla
+	if folderID := r.URL.Query().Get("validate"); folderID != "" {
+		serveValidate(w, r, credentialsJSON, rootFolderID, folderID)
+		return
+	}
+
+	// Modo zip: descargar todos los archivos de una carpeta de item de una vez
+	if folderID := r.URL.Query().Get("zip"); folderID != "" {
+		serveZip(w, r, credentialsJSON, rootFolderID, folderID)
+		return
+	}
+
+	// Comprimir la respuesta si el cliente acepta gzip
+	w.Header().Add("Vary", "Accept-Encoding")
+	if acceptsGzip(r) {
+		gz := newGzipResponseWriter(w)
+		defer gz.Close()
+		w = gz
+	}
+
+	limit, offset, err := parsePaging(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: err.Error()})
+		return
+	}
+
+	sortOrder := r.URL.Query().Get("sort")
+	if sortOrder != "" && sortOrder != "newest" && sortOrder != "oldest" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "sort must be newest or oldest"})
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "rss" && format != "csv" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "format must be json, rss or csv"})
+		return
+	}
+
+	urlMode := r.URL.Query().Get("urlMode")
+	if urlMode != "" && urlMode != "view" && urlMode != "thumbnail" && urlMode != "download" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "urlMode must be view, thumbnail or download"})
+		return
+	}
+
+	fields, err := parseFields(r.URL.Query().Get("fields"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: err.Error()})
+		return
+	}
+
+	videoURLMode := r.URL.Query().Get("videoUrlMode")
+	if videoURLMode != "" && videoURLMode != "preview" && videoURLMode != "download" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "videoUrlMode must be preview or download"})
+		return
+	}
+
+	thumbSize := defaultThumbnailSize
+	if raw := r.URL.Query().Get("thumbSize"); raw != "" {
+		thumbSize, err = strconv.Atoi(raw)
+		if err != nil || thumbSize <= 0 || thumbSize > maxThumbnailSize {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: fmt.Sprintf("thumbSize must be between 1 and %d", maxThumbnailSize)})
+			return
+		}
+	}
+
+	render := r.URL.Query().Get("render")
+	if render != "" && render != "html" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "render must be html"})
+		return
+	}
+
+	envelope := r.URL.Query().Get("envelope")
+	if envelope != "" && envelope != "data" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "envelope must be data"})
+		return
+	}
+
+	// stream escribe los items a medida que se procesan; necesita tenerlos
+	// todos para ordenar o paginar
+	stream := r.URL.Query().Get("stream") == "true"
+	if stream && (sortOrder != "" || limit > 0 || offset > 0 || (format != "" && format != "json") || envelope != "") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "stream cannot be combined with sort, limit, offset, format or envelope"})
+		return
+	}
+
+	maxImages := 0
+	if raw := r.URL.Query().Get("maxImages"); raw != "" {
+		maxImages, err = strconv.Atoi(raw)
+		if err != nil || maxImages <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "maxImages must be a positive integer"})
+			return
+		}
+	}
+
+	pageSize := 0
+	if raw := r.URL.Query().Get("pageSize"); raw != "" {
+		pageSize, err = strconv.Atoi(raw)
+		if err != nil || pageSize <= 0 || pageSize > maxDrivePageSize {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: fmt.Sprintf("pageSize must be between 1 and %d", maxDrivePageSize)})
+			return
+		}
+	}
+
+	// recent pide solo los N items modificados más recientemente, ordenados
+	// por fecha, y no se combina con la paginación por carpetas ni con grouped
+	recent := 0
+	if raw := r.URL.Query().Get("recent"); raw != "" {
+		recent, err = strconv.Atoi(raw)
+		if err != nil || recent <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "recent must be a positive integer"})
+			return
+		}
+		if r.URL.Query().Get("pageToken") != "" || pageSize > 0 || r.URL.Query().Get("grouped") == "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "recent cannot be combined with pageToken, pageSize or grouped"})
+			return
+		}
+	}
+
+	// modifiedSince devuelve solo los items cuya carpeta cambió después de esa
+	// fecha, para sincronizar de forma incremental
+	modifiedSince := ""
+	if raw := r.URL.Query().Get("modifiedSince"); raw != "" {
+		since, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "modifiedSince must be an RFC 3339 timestamp like 2024-01-02T15:04:05Z"})
+			return
+		}
+		if r.URL.Query().Get("grouped") == "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "modifiedSince cannot be combined with grouped"})
+			return
+		}
+		modifiedSince = since.UTC().Format(time.RFC3339)
+	}
+
+	lang := strings.ToLower(r.URL.Query().Get("lang"))
+	if lang != "" && !langPattern.MatchString(lang) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "lang must be a language code like es or en"})
+		return
+	}
+	// Sin lang explícito, el idioma sale de Accept-Language
+	if lang == "" {
+		w.Header().Add("Vary", "Accept-Language")
+		lang = negotiateLang(r.Header.Get("Accept-Language"))
+	}
+
+	opts := itemOptions{
+		lang:          lang,
+		driveID:       r.URL.Query().Get("driveId"),
+		grouped:       r.URL.Query().Get("grouped") == "true",
+		urlMode:       urlMode,
+		videoURLMode:  videoURLMode,
+		thumbSize:     thumbSize,
+		maxImages:     maxImages,
+		pageToken:     r.URL.Query().Get("pageToken"),
+		pageSize:      int64(pageSize),
+		recent:        recent,
+		blurPreview:   r.URL.Query().Get("blurPreview") == "true",
+		modifiedSince: modifiedSince,
+	}
+
+	// Modo carpetas: solo el ID y nombre de las carpetas de la raíz, para armar menús
+	if r.URL.Query().Get("listFolders") == "true" {
+		serveFolders(w, r, credentialsJSON, rootFolderID, opts)
+		return
+	}
+
+	// Modo conteo: solo se listan las carpetas, sin leer la metadata de cada item
+	if r.URL.Query().Get("countOnly") == "true" {
+		serveCount(w, r, credentialsJSON, rootFolderID, opts)
+		return
+	}
+
+	key := opts.cacheKey(rootFolderID)
+
+	// Servir desde cache si todavía no venció el TTL
+	result, ok := itemsCache.Get(r.Context(), key)
+	if ok {
+		metrics.cacheHits.Add(1)
+	} else {
+		metrics.cacheMisses.Add(1)
+		srv, err := getDriveService(r.Context(), credentialsJSON)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: fmt.Sprintf("Unable to create Drive client: %v", err)})
+			return
+		}
+
+		// Limitar cuánto puede tardar Drive para no consumir la función hasta que la plataforma la corte
+		ctx, cancel := context.WithTimeout(r.Context(), requestTimeout())
+		defer cancel()
+
+		opts.sheet, err = loadSheetMetadata(ctx, credentialsJSON)
+		if err != nil {
+			writeDriveError(ctx, w, r, err)
+			return
+		}
+		if opts.blurPreview {
+			opts.httpClient, err = getHTTPClient(r.Context(), credentialsJSON)
+			if err != nil {
+				writeDriveError(ctx, w, r, err)
+				return
+			}
+		}
+
+		if stream {
+			streamItems(ctx, w, r, srv, rootFolderID, opts, render == "html", fields)
+			return
+		}
+
+		result, err = getItems(ctx, srv, rootFolderID, opts)
+		if err != nil {
+			writeDriveError(ctx, w, r, err)
+			return
+		}
+
+		itemsCache.Set(ctx, key, result, cacheTTL())
+	}
+
+	// Modo item: un solo item por slug, con su propio ETag
+	if slug := r.URL.Query().Get("item"); slug != "" {
+		serveItem(w, r, result, slug, render == "html")
+		return
+	}
+
+	// El ETag depende de las carpetas, del idioma y de los parámetros, que cambian el resultado
+	etag := makeETag(result.version+"|"+opts.lang, r.URL.RawQuery)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl(getEnvInt("CACHE_MAX_AGE", 60)))
+	if !result.lastModified.IsZero() {
+		w.Header().Set("Last-Modified", result.lastModified.UTC().Format(http.TimeFormat))
+	}
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Filtros opcionales sobre los items (no modifican lo cacheado)
+	items := filterItems(result.items, r.URL.Query())
+
+	if sortOrder != "" {
+		items = sortItems(items, sortOrder)
+	}
+
+	total := len(items)
+	items = paginate(items, limit, offset)
+
+	if render == "html" {
+		items = renderDescriptions(items)
+	}
+
+	switch format {
+	case "rss":
+		writeRSS(w, r, items)
+		return
+	case "csv":
+		writeCSV(w, items)
+		return
+	}
+
+	// Sin items se devuelve "items": [] y no null
+	if items == nil {
+		items = []Item{}
+	}
+	response := Response{Items: items, Total: total, NextPageToken: result.nextPageToken, Truncated: result.truncated, Meta: result.meta, Warnings: result.warnings}
+	var payload interface{} = response
+	if len(fields) > 0 {
+		payload = partialResponse{Response: response, Items: selectFields(items, fields)}
+	}
+	if envelope == "data" {
+		data := interface{}(items)
+		if len(fields) > 0 {
+			data = selectFields(items, fields)
+		}
+		payload = EnvelopeResponse{
+			Data: data,
+			Meta: EnvelopeMeta{
+				Total:         total,
+				Limit:         limit,
+				Offset:        offset,
+				NextPageToken: result.nextPageToken,
+				Truncated:     result.truncated,
+				Gallery:       result.meta,
+				Warnings:      result.warnings,
+			},
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: err.Error()})
+		return
+	}
+	body = append(body, '\n')
+	// Con gzip el largo final no se conoce hasta terminar de comprimir
+	if _, compressed := w.(*gzipResponseWriter); !compressed {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	w.Write(body)
+}
+
+// EnvelopeResponse es la respuesta con envelope=data: los items van en data y
+// los datos de paginación en meta
+type EnvelopeResponse struct {
+	Data interface{}  `json:"data"`
+	Meta EnvelopeMeta `json:"meta"`
+}
+
+// EnvelopeMeta acompaña a los items en EnvelopeResponse
+type EnvelopeMeta struct {
+	Total         int      `json:"total"`
+	Limit         int      `json:"limit,omitempty"`
+	Offset        int      `json:"offset"`
+	NextPageToken string   `json:"nextPageToken,omitempty"`
+	Truncated     bool     `json:"truncated,omitempty"`
+	Gallery       *Meta    `json:"gallery,omitempty"`
+	Warnings      []string `json:"warnings,omitempty"`
+}
+
+// partialResponse es Response con cada item recortado a los campos pedidos en fields
+type partialResponse struct {
+	Response
+	Items []map[string]json.RawMessage `json:"items"`
+}
+
+// fieldAliases agrupa campos relacionados bajo un nombre corto para fields
+var fieldAliases = map[string][]string{
+	"cover":  {"coverUrl"},
+	"images": {"images", "imageUrls", "thumbnails"},
+	"videos": {"videos", "videoUrls"},
+	"audios": {"audioUrls"},
+}
+
+// itemJSONFields son los nombres JSON de los campos de Item
+var itemJSONFields = func() map[string]bool {
+	names := make(map[string]bool)
+	t := reflect.TypeOf(Item{})
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}()
+
+// parseFields lee el parámetro fields (ej. "title,cover,images") y devuelve los
+// nombres JSON de los campos a incluir, o nil si se piden todos.
+func parseFields(raw string) ([]string, error) {
+	var fields []string
+	for _, name := range parseList(raw) {
+		if expanded, ok := fieldAliases[name]; ok {
+			fields = append(fields, expanded...)
+			continue
+		}
+		if !itemJSONFields[name] {
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+		fields = append(fields, name)
+	}
+	return fields, nil
+}
+
+// selectFields convierte los items a objetos JSON con solo los campos pedidos
+func selectFields(items []Item, fields []string) []map[string]json.RawMessage {
+	selected := make([]map[string]json.RawMessage, 0, len(items))
+	for _, item := range items {
+		encoded, _ := json.Marshal(item)
+		var all map[string]json.RawMessage
+		json.Unmarshal(encoded, &all)
+
+		partial := make(map[string]json.RawMessage, len(fields))
+		for _, field := range fields {
+			if value, ok := all[field]; ok {
+				partial[field] = value
+			}
+		}
+		selected = append(selected, partial)
+	}
+	return selected
+}
+
+// serveItem devuelve el item con ese slug. Su ETag depende solo de su carpeta
+// y su metadata, así la página de detalle se puede cachear aunque cambien
+// otros items.
+func serveItem(w http.ResponseWriter, r *http.Request, result itemsResult, slug string, render bool) {
+	var found *Item
+	for i := range result.items {
+		if result.items[i].Slug == slug {
+			found = &result.items[i]
+			break
+		}
+	}
+	if found == nil || (found.Status == "draft" && r.URL.Query().Get("includeDrafts") != "true") {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "Item not found"})
+		return
+	}
+
+	// El ETag sale del item codificado: Drive no cambia el modifiedTime de la
+	// carpeta cuando cambian sus archivos
+	encoded, _ := json.Marshal(found)
+	etag := makeETag(string(encoded), r.URL.RawQuery)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl(getEnvInt("CACHE_MAX_AGE", 60)))
+	if t, ok := parseItemTime(found.UpdatedAt); ok {
+		w.Header().Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+	}
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	item := *found
+	if render {
+		item = renderDescriptions([]Item{item})[0]
+	}
+	json.NewEncoder(w).Encode(item)
+}
+
+// driveErrorMessages es el mensaje fijo que recibe el cliente para cada
+// errorCode. El error completo, que puede incluir URLs y consultas internas,
+// solo va a los logs.
+var driveErrorMessages = map[string]string{
+	"credentials_misconfigured": errCredentialsMisconfigured.Error(),
+	"timeout":                   "Timed out waiting for Google Drive",
+	"drive_rate_limited":        "Google Drive rate limit exceeded",
+	"drive_forbidden":           "Access to the Google Drive folder was denied",
+	"drive_not_found":           "Google Drive folder or file not found",
+	"internal_error":            "Internal error while querying Google Drive",
+}
+
+// classifyDriveError elige el status HTTP, un código corto para que el cliente
+// distinga el caso y el mensaje fijo de ese código para un error al consultar
+// Drive, y deja el error completo en los logs
+func classifyDriveError(ctx context.Context, err error) (int, string, string) {
+	status, code := driveErrorClass(ctx, err)
+	loggerFrom(ctx).Error("drive request failed", "errorCode", code, "error", err.Error())
+	return status, code, driveErrorMessages[code]
+}
+
+// driveErrorClass es la clasificación de classifyDriveError, sin el log
+func driveErrorClass(ctx context.Context, err error) (int, string) {
+	if isCredentialsError(err) {
+		return http.StatusInternalServerError, "credentials_misconfigured"
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout, "timeout"
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.Code == http.StatusTooManyRequests || isRetryable(apiErr) && apiErr.Code == http.StatusForbidden:
+			// Drive informa los límites de cuota como 403 con motivo rateLimitExceeded
+			return http.StatusTooManyRequests, "drive_rate_limited"
+		case apiErr.Code == http.StatusForbidden:
+			return http.StatusForbidden, "drive_forbidden"
+		case apiErr.Code == http.StatusNotFound:
+			return http.StatusNotFound, "drive_not_found"
+		}
+	}
+	return http.StatusInternalServerError, "internal_error"
+}
+
+// isCredentialsError indica si el error viene de las credenciales y no de
+// Drive: el cliente no se pudo crear o no se pudo obtener el token del Service
+// Account (por ejemplo, una private_key inválida).
+func isCredentialsError(err error) bool {
+	if errors.Is(err, errCredentialsMisconfigured) {
+		return true
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return false
+	}
+	message := err.Error()
+	return strings.Contains(message, "oauth2:") || strings.Contains(message, "private key")
+}
+
+// writeDriveError responde con el status y el código que corresponden al error
+func writeDriveError(ctx context.Context, w http.ResponseWriter, r *http.Request, err error) {
+	status, code, message := classifyDriveError(ctx, err)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: message, ErrorCode: code})
+}
+
+// filterItems aplica los filtros opcionales de la query
+func filterItems(items []Item, query url.Values) []Item {
+	if query.Get("includeDrafts") != "true" {
+		items = excludeDrafts(items)
+	}
+	if query.Get("strict") == "true" {
+		items = excludeInvalid(items)
+	}
+	if query.Get("featured") == "true" {
+		items = filterFeatured(items)
+	}
+	if tag := query.Get("tag"); tag != "" {
+		items = filterByTag(items, tag)
+	}
+	if prefix := strings.TrimSpace(query.Get("codePrefix")); prefix != "" {
+		items = filterByCodePrefix(items, prefix)
+	}
+	if q := strings.TrimSpace(query.Get("q")); q != "" {
+		items = searchItems(items, q)
+	}
+	return items
+}
+
+// streamItems lee la carpeta raíz y escribe cada item apenas se procesa su
+// carpeta, para que el cliente reciba datos antes de que termine todo. El
+// JSON tiene la misma forma que Response; si Drive falla a mitad de camino se
+// cierra la lista y se agrega el campo error. Los slugs son los mismos que
+// los de getItems, que quedan en el cache.
+func streamItems(ctx context.Context, w http.ResponseWriter, r *http.Request, srv *drive.Service, rootFolderID string, opts itemOptions, render bool, fields []string) {
+	page, err := listItemFolders(ctx, srv, rootFolderID, opts)
+	if err != nil {
+		writeDriveError(ctx, w, r, err)
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, `{"items":[`)
+
+	var result itemsResult
+	result.truncated = truncateFolders(ctx, &page)
+	slugs := make(map[string]bool)
+	total := 0
+	folders := page.folders
+	results := make([]folderResult, len(folders))
+	rootMeta := fetchRootMeta(ctx, srv, rootFolderID, opts)
+	processFolders(ctx, srv, folders, page.categories, opts, func(i int, res folderResult) {
+		results[i] = res
+		if res.err != nil {
+			return
+		}
+
+		item := res.item
+		item.Slug = uniqueSlug(slugs, item.Title, folders[i].Id)
+
+		visible := filterItems([]Item{item}, r.URL.Query())
+		if len(visible) == 0 {
+			return
+		}
+		if render {
+			visible = renderDescriptions(visible)
+		}
+		var payload interface{} = visible[0]
+		if len(fields) > 0 {
+			payload = selectFields(visible, fields)[0]
+		}
+		encoded, err := json.Marshal(payload)
+		if err != nil {
+			return
+		}
+		if total > 0 {
+			io.WriteString(w, ",")
+		}
+		w.Write(encoded)
+		total++
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+
+	result.items, result.warnings = collectResults(ctx, results, folders)
+	result.meta, result.warnings = collectRootMeta(ctx, rootMeta, result.warnings)
+
+	fmt.Fprintf(w, `],"total":%d`, total)
+	if page.nextPageToken != "" {
+		encoded, _ := json.Marshal(page.nextPageToken)
+		fmt.Fprintf(w, `,"nextPageToken":%s`, encoded)
+	}
+	if result.truncated {
+		io.WriteString(w, `,"truncated":true`)
+	}
+	if result.meta != nil {
+		encoded, _ := json.Marshal(result.meta)
+		fmt.Fprintf(w, `,"meta":%s`, encoded)
+	}
+	if len(result.warnings) > 0 {
+		encoded, _ := json.Marshal(result.warnings)
+		fmt.Fprintf(w, `,"warnings":%s`, encoded)
+	}
+	if err := ctx.Err(); err != nil {
+		_, code, message := classifyDriveError(ctx, err)
+		encoded, _ := json.Marshal(message)
+		id, _ := json.Marshal(requestIDFrom(ctx))
+		fmt.Fprintf(w, `,"error":%s,"errorCode":%q,"requestId":%s}`+"\n", encoded, code, id)
+		return
+	}
+	io.WriteString(w, "}\n")
+
+	// Lo leído completo queda en el cache para las próximas peticiones
+	result.version = resultVersion(folders, result.items, opts)
+	result.lastModified = latestModified(folders)
+	result.nextPageToken = page.nextPageToken
+	itemsCache.Set(ctx, opts.cacheKey(rootFolderID), result, cacheTTL())
+}
+
+// CountResponse es la respuesta del modo countOnly
+type CountResponse struct {
+	Total     int    `json:"total"`
+	RequestID string `json:"requestId,omitempty"`
+	Error     string `json:"error,omitempty"`
+	ErrorCode string `json:"errorCode,omitempty"`
+}
+
+// serveCount devuelve cuántas carpetas de items hay en la raíz. No descarga
+// metadata, por lo que los borradores también se cuentan.
+func serveCount(w http.ResponseWriter, r *http.Request, credentialsJSON, rootFolderID string, opts itemOptions) {
+	srv, err := getDriveService(r.Context(), credentialsJSON)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(CountResponse{RequestID: requestIDFrom(r.Context()), Error: fmt.Sprintf("Unable to create Drive client: %v", err)})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout())
+	defer cancel()
+
+	// Drive devuelve las carpetas de a páginas: se recorren todas, con el
+	// máximo por página si no se pidió otro tamaño
+	if opts.pageSize == 0 {
+		opts.pageSize = maxDrivePageSize
+	}
+	total := 0
+	for {
+		page, err := listItemFolders(ctx, srv, rootFolderID, opts)
+		if err != nil {
+			status, code, message := classifyDriveError(ctx, err)
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(CountResponse{RequestID: requestIDFrom(r.Context()), Error: message, ErrorCode: code})
+			return
+		}
+		total += len(page.folders)
+		if page.nextPageToken == "" {
+			break
+		}
+		opts.pageToken = page.nextPageToken
+	}
+
+	w.Header().Set("Cache-Control", cacheControl(getEnvInt("CACHE_MAX_AGE", 60)))
+	json.NewEncoder(w).Encode(CountResponse{Total: total})
+}
+
+// Folder es una carpeta de la raíz en el modo listFolders
+type Folder struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// FoldersResponse es la respuesta del modo listFolders
+type FoldersResponse struct {
+	Folders   []Folder `json:"folders"`
+	RequestID string   `json:"requestId,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	ErrorCode string   `json:"errorCode,omitempty"`
+}
+
+// serveFolders devuelve las carpetas visibles que cuelgan de la raíz, sin
+// listar su contenido.
+func serveFolders(w http.ResponseWriter, r *http.Request, credentialsJSON, rootFolderID string, opts itemOptions) {
+	srv, err := getDriveService(r.Context(), credentialsJSON)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(FoldersResponse{RequestID: requestIDFrom(r.Context()), Error: fmt.Sprintf("Unable to create Drive client: %v", err)})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout())
+	defer cancel()
+
+	query := fmt.Sprintf("'%s' in parents and mimeType='%s' and trashed=false", rootFolderID, folderMimeType)
+	files, err := listAllFiles(ctx, srv, query, "id, name", opts)
+	if err != nil {
+		status, code, message := classifyDriveError(ctx, fmt.Errorf("error listing folders: %w", err))
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(FoldersResponse{RequestID: requestIDFrom(r.Context()), Error: message, ErrorCode: code})
+		return
+	}
+
+	folders := visibleFolders(files)
+	sortFilesByName(folders)
+	response := FoldersResponse{Folders: make([]Folder, 0, len(folders))}
+	for _, folder := range folders {
+		response.Folders = append(response.Folders, Folder{ID: folder.Id, Name: folder.Name})
+	}
+
+	w.Header().Set("Cache-Control", cacheControl(getEnvInt("CACHE_MAX_AGE", 60)))
+	json.NewEncoder(w).Encode(response)
+}
+
+// rssFeed y los tipos siguientes modelan un documento RSS 2.0
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Description string   `xml:"description"`
+	GUID        *rssGUID `xml:"guid,omitempty"`
+	PubDate     string   `xml:"pubDate,omitempty"`
+	Category    string   `xml:"category,omitempty"`
+}
+
+type rssGUID struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+// writeRSS escribe los items como feed RSS 2.0. El título y el enlace del
+// canal se configuran con FEED_TITLE y FEED_LINK; cada item enlaza a su
+// primera imagen.
+func writeRSS(w http.ResponseWriter, r *http.Request, items []Item) {
+	channelLink := os.Getenv("FEED_LINK")
+	if channelLink == "" {
+		channelLink = "https://" + r.Host + r.URL.Path
+	}
+	title := os.Getenv("FEED_TITLE")
+	if title == "" {
+		title = "Items"
+	}
+
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       title,
+			Link:        channelLink,
+			Description: title,
+			Items:       make([]rssItem, 0, len(items)),
+		},
+	}
+	for _, item := range items {
+		entry := rssItem{
+			Title:       item.Title,
+			Link:        channelLink,
+			Description: item.Description,
+			Category:    item.Category,
+		}
+		if len(item.ImageURLs) > 0 {
+			entry.Link = item.ImageURLs[0]
+		}
+		if item.Code != "" {
+			entry.GUID = &rssGUID{Value: item.Code}
+		}
+		if t, ok := parseItemTime(item.UpdatedAt); ok {
+			entry.PubDate = t.Format(time.RFC1123Z)
+		}
+		feed.Channel.Items = append(feed.Channel.Items, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	io.WriteString(w, xml.Header)
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	encoder.Encode(feed)
+}
+
+// writeCSV escribe los items como CSV para abrirlos en una planilla
+func writeCSV(w http.ResponseWriter, items []Item) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="items.csv"`)
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"title", "subtitle", "description", "code", "imageCount"})
+	for _, item := range items {
+		writer.Write([]string{
+			item.Title,
+			item.Subtitle,
+			item.Description,
+			item.Code,
+			strconv.Itoa(len(item.ImageURLs)),
+		})
+	}
+	writer.Flush()
+}
+
+// parsePaging lee limit y offset de la query. Sin limit se devuelven todos los
+// items; un limit mayor a maxPageLimit se recorta.
+func parsePaging(query url.Values) (int, int, error) {
+	limit := 0
+	if raw := query.Get("limit"); raw != "" {
+		value, err := strconv.Atoi(raw)
+		if err != nil || value <= 0 {
+			return 0, 0, fmt.Errorf("limit must be a positive integer")
+		}
+		limit = value
+		if limit > maxPageLimit {
+			limit = maxPageLimit
+		}
+	}
+
+	offset := 0
+	if raw := query.Get("offset"); raw != "" {
+		value, err := strconv.Atoi(raw)
+		if err != nil || value < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+		offset = value
+	}
+
+	return limit, offset, nil
+}
+
+// paginate devuelve la porción de items indicada por limit y offset (limit 0 = sin límite)
+func paginate(items []Item, limit, offset int) []Item {
+	if offset >= len(items) {
+		return []Item{}
+	}
+	items = items[offset:]
+	if limit > 0 && limit < len(items) {
+		items = items[:limit]
+	}
+	return items
+}
+
+// statusWriter recuerda el status de la respuesta para las métricas
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusWriter) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusWriter) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush permite seguir enviando la respuesta de a partes en el modo stream
+func (s *statusWriter) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// headResponseWriter descarta el cuerpo para responder peticiones HEAD
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (h headResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// makeETag arma un ETag débil a partir de la versión de las carpetas y la query
+func makeETag(version, rawQuery string) string {
+	sum := sha256.Sum256([]byte(version + "?" + rawQuery))
+	return fmt.Sprintf(`W/"%x"`, sum[:16])
+}
+
+// etagMatches compara If-None-Match (que puede traer varios ETags o "*") con el actual
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter comprime todo lo que se escribe en la respuesta. El
+// compresor se crea recién al escribir el status, para que las respuestas sin
+// cuerpo (304, 204) salgan sin Content-Encoding.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz     *gzip.Writer
+	noBody bool
+}
+
+func newGzipResponseWriter(w http.ResponseWriter) *gzipResponseWriter {
+	return &gzipResponseWriter{ResponseWriter: w}
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if status == http.StatusNotModified || status == http.StatusNoContent {
+		g.noBody = true
+	} else if g.gz == nil {
+		g.Header().Set("Content-Encoding", "gzip")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if g.gz == nil {
+		if g.noBody {
+			return g.ResponseWriter.Write(b)
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	return g.gz.Write(b)
+}
+
+// Flush envía al cliente lo comprimido hasta el momento
+func (g *gzipResponseWriter) Flush() {
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if flusher, ok := g.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close vacía el buffer y escribe el cierre del stream gzip
+func (g *gzipResponseWriter) Close() error {
+	if g.gz == nil {
+		return nil
+	}
+	return g.gz.Close()
+}
+
+// acceptsGzip indica si Accept-Encoding incluye gzip con un q distinto de cero
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), "gzip") {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// excludeDrafts quita los items marcados con "status: draft". Los items sin
+// status se consideran publicados.
+func excludeDrafts(items []Item) []Item {
+	var published []Item
+	for _, item := range items {
+		if item.Status != "draft" {
+			published = append(published, item)
+		}
+	}
+	return published
+}
+
+// excludeInvalid quita los items a los que les falta algún campo obligatorio
+func excludeInvalid(items []Item) []Item {
+	var valid []Item
+	for _, item := range items {
+		if !item.invalid {
+			valid = append(valid, item)
+		}
+	}
+	return valid
+}
+
+// filterFeatured devuelve los items destacados
+func filterFeatured(items []Item) []Item {
+	var featured []Item
+	for _, item := range items {
+		if item.Featured {
+			featured = append(featured, item)
+		}
+	}
+	return featured
+}
+
+// filterByTag devuelve los items que tienen el tag indicado (sin distinguir mayúsculas)
+func filterByTag(items []Item, tag string) []Item {
+	var filtered []Item
+	for _, item := range items {
+		for _, t := range item.Tags {
+			if strings.EqualFold(t, tag) {
+				filtered = append(filtered, item)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// filterByCodePrefix devuelve los items cuyo código empieza con el prefijo,
+// sin distinguir mayúsculas. Los items sin código quedan afuera.
+func filterByCodePrefix(items []Item, prefix string) []Item {
+	prefix = strings.ToLower(prefix)
+	var filtered []Item
+	for _, item := range items {
+		if item.Code != "" && strings.HasPrefix(strings.ToLower(item.Code), prefix) {
+			filtered = append(filtered, item)
+		}
+	}
+	return filtered
+}
+
+// searchItems devuelve los items cuyo título, subtítulo o descripción
+// contienen el texto buscado, sin distinguir mayúsculas ni acentos.
+func searchItems(items []Item, q string) []Item {
+	needle := foldText(q)
+	var matches []Item
+	for _, item := range items {
+		for _, field := range []string{item.Title, item.Subtitle, item.Description} {
+			if strings.Contains(foldText(field), needle) {
+				matches = append(matches, item)
+				break
+			}
+		}
+	}
+	return matches
+}
+
+// descriptionPolicy deja solo el HTML que puede generar el markdown de las
+// descripciones, sin scripts, atributos de eventos ni URLs javascript:
+var descriptionPolicy = bluemonday.UGCPolicy()
+
+// renderDescriptions devuelve una copia de los items con DescriptionHTML
+// completo. Los items cacheados no se modifican.
+func renderDescriptions(items []Item) []Item {
+	rendered := make([]Item, len(items))
+	for i, item := range items {
+		item.DescriptionHTML = renderMarkdown(item.Description)
+		rendered[i] = item
+	}
+	return rendered
+}
+
+// renderMarkdown convierte markdown a HTML. goldmark ya omite el HTML crudo
+// del texto; el sanitizador cubre además los enlaces e imágenes generados.
+func renderMarkdown(source string) string {
+	if source == "" {
+		return ""
+	}
+	var buf bytes.Buffer
+	if err := goldmark.Convert([]byte(source), &buf); err != nil {
+		return descriptionPolicy.Sanitize(source)
+	}
+	return strings.TrimSpace(descriptionPolicy.Sanitize(buf.String()))
+}
+
+// foldText pasa el texto a minúsculas y le quita los acentos ("Canción" -> "cancion")
+func foldText(text string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(text) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// Cache guarda los resultados calculados por clave hasta que vence su TTL.
+// Las claves empiezan con el ID de la carpeta raíz (ver itemOptions.cacheKey).
+type Cache interface {
+	Get(ctx context.Context, key string) (itemsResult, bool)
+	Set(ctx context.Context, key string, result itemsResult, ttl time.Duration)
+	Delete(ctx context.Context, key string)
+	// DeleteFolder borra todas las entradas de una carpeta raíz, sea cual sea
+	// el resto de las opciones, y devuelve cuántas había
+	DeleteFolder(ctx context.Context, rootFolderID string) int
+}
+
+// itemsCache es el cache de resultados: Redis si REDIS_URL está definida,
+// para compartirlo entre instancias, o memoria si no.
+var itemsCache = newCache()
+
+func newCache() Cache {
+	if rawURL := os.Getenv("REDIS_URL"); rawURL != "" {
+		cache, err := newRedisCache(rawURL)
+		if err == nil {
+			return cache
+		}
+		// Sin Redis se sigue funcionando, con un cache por instancia
+		logger.Error("invalid REDIS_URL, using the in-memory cache", "error", err.Error())
+	}
+	return newMemoryCache()
+}
+
+// cacheEntry guarda el resultado calculado para una carpeta raíz
+type cacheEntry struct {
+	result    itemsResult
+	expiresAt time.Time
+}
+
+// memoryCache es un cache en memoria que sobrevive entre invocaciones
+// mientras el contenedor de Vercel se mantiene caliente.
+type memoryCache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{entries: make(map[string]cacheEntry)}
+}
+
+func (c *memoryCache) Get(ctx context.Context, key string) (itemsResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return itemsResult{}, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(c.entries, key)
+		return itemsResult{}, false
+	}
+	return entry.result, true
+}
+
+func (c *memoryCache) Set(ctx context.Context, key string, result itemsResult, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Limpiar entradas vencidas para que el mapa no crezca indefinidamente
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.After(entry.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[key] = cacheEntry{result: result, expiresAt: now.Add(ttl)}
+}
+
+func (c *memoryCache) Delete(ctx context.Context, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+func (c *memoryCache) DeleteFolder(ctx context.Context, rootFolderID string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for key := range c.entries {
+		if strings.HasPrefix(key, rootFolderID+"|") {
+			delete(c.entries, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// redisKeyPrefix separa las claves de este servicio de otras en la misma base
+const redisKeyPrefix = "page-backend:items:"
+
+// redisTimeout acota cada operación con Redis: si tarda, se sigue como si
+// fuera un miss en lugar de demorar la respuesta
+const redisTimeout = 2 * time.Second
+
+// redisCache guarda los resultados en Redis, compartidos entre instancias.
+// Los errores de Redis se registran y se tratan como un miss.
+type redisCache struct {
+	client *redis.Client
+}
+
+func newRedisCache(rawURL string) (*redisCache, error) {
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &redisCache{client: redis.NewClient(opts)}, nil
+}
+
+// storedResult es itemsResult tal como se guarda en Redis. Los campos internos
+// de Item no salen en su JSON, así que viajan en listas paralelas a Items.
+type storedResult struct {
+	Items         []Item    `json:"items"`
+	Invalid       []bool    `json:"invalid"`
+	Version       string    `json:"version"`
+	Warnings      []string  `json:"warnings,omitempty"`
+	LastModified  time.Time `json:"lastModified"`
+	NextPageToken string    `json:"nextPageToken,omitempty"`
+	Meta          *Meta     `json:"meta,omitempty"`
+	Truncated     bool      `json:"truncated,omitempty"`
+}
+
+func (c *redisCache) Get(ctx context.Context, key string) (itemsResult, bool) {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+
+	data, err := c.client.Get(ctx, redisKeyPrefix+key).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			loggerFrom(ctx).Warn("redis cache get failed", "error", err.Error())
+		}
+		return itemsResult{}, false
+	}
+
+	var stored storedResult
+	if err := json.Unmarshal(data, &stored); err != nil || len(stored.Invalid) != len(stored.Items) {
+		loggerFrom(ctx).Warn("discarding malformed redis cache entry", "key", key)
+		return itemsResult{}, false
+	}
+	for i := range stored.Items {
+		stored.Items[i].invalid = stored.Invalid[i]
+	}
+	return itemsResult{
+		items:         stored.Items,
+		version:       stored.Version,
+		warnings:      stored.Warnings,
+		lastModified:  stored.LastModified,
+		nextPageToken: stored.NextPageToken,
+		meta:          stored.Meta,
+		truncated:     stored.Truncated,
+	}, true
+}
+
+func (c *redisCache) Set(ctx context.Context, key string, result itemsResult, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	stored := storedResult{
+		Items:         result.items,
+		Invalid:       make([]bool, len(result.items)),
+		Version:       result.version,
+		Warnings:      result.warnings,
+		LastModified:  result.lastModified,
+		NextPageToken: result.nextPageToken,
+		Meta:          result.meta,
+		Truncated:     result.truncated,
+	}
+	for i, item := range result.items {
+		stored.Invalid[i] = item.invalid
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		loggerFrom(ctx).Warn("redis cache encode failed", "error", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	if err := c.client.Set(ctx, redisKeyPrefix+key, data, ttl).Err(); err != nil {
+		loggerFrom(ctx).Warn("redis cache set failed", "error", err.Error())
+	}
+}
+
+func (c *redisCache) Delete(ctx context.Context, key string) {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	if err := c.client.Del(ctx, redisKeyPrefix+key).Err(); err != nil {
+		loggerFrom(ctx).Warn("redis cache delete failed", "error", err.Error())
+	}
+}
+
+func (c *redisCache) DeleteFolder(ctx context.Context, rootFolderID string) int {
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+
+	// Los IDs de Drive no tienen caracteres especiales para el patrón de SCAN
+	removed := 0
+	iter := c.client.Scan(ctx, 0, redisKeyPrefix+rootFolderID+"|*", 100).Iterator()
+	for iter.Next(ctx) {
+		if err := c.client.Del(ctx, iter.Val()).Err(); err != nil {
+			loggerFrom(ctx).Warn("redis cache delete failed", "error", err.Error())
+			continue
+		}
+		removed++
+	}
+	if err := iter.Err(); err != nil {
+		loggerFrom(ctx).Warn("redis cache scan failed", "error", err.Error())
+	}
+	return removed
+}
+
+// cacheControl arma el header Cache-Control de las respuestas cacheables.
+// Con API_KEY son privadas, para que un CDN o proxy compartido no entregue a
+// otros clientes lo que se pidió con la clave.
+func cacheControl(maxAge int) string {
+	if os.Getenv("API_KEY") != "" {
+		return fmt.Sprintf("private, max-age=%d", maxAge)
+	}
+	return fmt.Sprintf("public, max-age=%d", maxAge)
+}
+
+// cacheTTL lee CACHE_TTL_SECONDS (por defecto 60). Un valor 0 desactiva el cache.
+func cacheTTL() time.Duration {
+	return time.Duration(getEnvInt("CACHE_TTL_SECONDS", 60)) * time.Second
+}
+
+// getEnvInt lee una variable de entorno entera, usando def si no está
+// definida o no es un número válido.
+func getEnvInt(name string, def int) int {
+	value, err := strconv.Atoi(strings.TrimSpace(os.Getenv(name)))
+	if err != nil || value < 0 {
+		return def
+	}
+	return value
+}
+
+// HealthResponse es la respuesta del modo health
+type HealthResponse struct {
+	Status    string `json:"status"`
+	RequestID string `json:"requestId,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// serveHealth confirma que las credenciales funcionan y que la carpeta raíz es
+// accesible con un único Files.Get, sin listar ni descargar nada.
+func serveHealth(w http.ResponseWriter, r *http.Request, credentialsJSON, rootFolderID string) {
+	// Ningún resultado se cachea: un monitor debe ver siempre el estado actual
+	w.Header().Set("Cache-Control", "no-store")
+	unhealthy := func(reason string) {
+		loggerFrom(r.Context()).Warn("health check failed", "reason", reason)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(HealthResponse{Status: "error", RequestID: requestIDFrom(r.Context()), Error: reason})
+	}
+
+	if credentialsJSON == "" {
+		unhealthy("Google credentials not configured")
+		return
+	}
+	if rootFolderID == "" {
+		unhealthy("Folder ID is required")
+		return
+	}
+
+	srv, err := getDriveService(r.Context(), credentialsJSON)
+	if err != nil {
+		unhealthy(fmt.Sprintf("Unable to create Drive client: %v", err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout())
+	defer cancel()
+
+	folder, err := srv.Files.Get(rootFolderID).Fields("id, mimeType").SupportsAllDrives(true).Context(ctx).Do()
+	if err != nil {
+		_, _, message := classifyDriveError(ctx, err)
+		unhealthy("Unable to access root folder: " + message)
+		return
+	}
+	if folder.MimeType != folderMimeType {
+		unhealthy("Root folder ID does not point to a folder")
+		return
+	}
+
+	json.NewEncoder(w).Encode(HealthResponse{Status: "ok"})
+}
+
+// serveWebhook recibe las notificaciones push de Drive (Files.Watch sobre la
+// carpeta raíz) y borra del cache los items de esa carpeta. El canal debe
+// crearse con el token de DRIVE_WEBHOOK_TOKEN y con una dirección que indique
+// la carpeta en folderId; sin folderId se usa GOOGLE_DRIVE_FOLDER_ID.
+func serveWebhook(w http.ResponseWriter, r *http.Request) {
+	token := os.Getenv("DRIVE_WEBHOOK_TOKEN")
+	provided := r.Header.Get("X-Goog-Channel-Token")
+	if token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "Invalid channel token"})
+		return
+	}
+
+	rootFolderID, err := resolveRootFolder(r.Context(), r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: err.Error()})
+		return
+	}
+	if rootFolderID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "Folder ID is required"})
+		return
+	}
+
+	// "sync" solo confirma que el canal se creó, no indica cambios
+	state := r.Header.Get("X-Goog-Resource-State")
+	if state != "sync" {
+		removed := itemsCache.DeleteFolder(r.Context(), rootFolderID)
+		loggerFrom(r.Context()).Info("cache invalidated by drive notification",
+			"folderId", rootFolderID,
+			"channelId", r.Header.Get("X-Goog-Channel-ID"),
+			"resourceState", state,
+			"entries", removed)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resolveRootFolder elige la carpeta raíz: folderId si viene en la query; si
+// no, la del sitio indicado en site según SITE_FOLDERS; y si no,
+// GOOGLE_DRIVE_FOLDER_ID.
+func resolveRootFolder(ctx context.Context, query url.Values) (string, error) {
+	if folderID := query.Get("folderId"); folderID != "" {
+		if !isDriveID(folderID) {
+			return "", fmt.Errorf("folderId must be a valid Drive ID")
+		}
+		return folderID, nil
+	}
+	if site := query.Get("site"); site != "" {
+		folderID, ok := siteFolders(ctx)[site]
+		if !ok || folderID == "" {
+			return "", fmt.Errorf("unknown site %q", site)
+		}
+		return folderID, nil
+	}
+	return os.Getenv("GOOGLE_DRIVE_FOLDER_ID"), nil
+}
+
+// driveIDPattern son los caracteres que usan los IDs de Drive
+var driveIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// isDriveID indica si el valor puede ser un ID de Drive. Evita que un valor con
+// comillas altere las consultas que se arman con fmt.Sprintf.
+func isDriveID(value string) bool {
+	return driveIDPattern.MatchString(value)
+}
+
+// siteFolders lee SITE_FOLDERS, un objeto JSON que asocia nombres de sitio con
+// carpetas raíz (ej. {"prod":"abc","staging":"def"}).
+func siteFolders(ctx context.Context) map[string]string {
+	raw := strings.TrimSpace(os.Getenv("SITE_FOLDERS"))
+	if raw == "" {
+		return nil
+	}
+
+	var sites map[string]string
+	if err := json.Unmarshal([]byte(raw), &sites); err != nil {
+		loggerFrom(ctx).Warn("invalid SITE_FOLDERS", "error", err.Error())
+		return nil
+	}
+	return sites
+}
+
+// serverMetrics son contadores que viven mientras el contenedor siga caliente
+type serverMetrics struct {
+	requests    atomic.Int64
+	errors      atomic.Int64
+	cacheHits   atomic.Int64
+	cacheMisses atomic.Int64
+	driveCalls  atomic.Int64
+	driveErrors atomic.Int64
+}
+
+var metrics = &serverMetrics{}
+
+// MetricsResponse es la respuesta JSON del modo metrics
+type MetricsResponse struct {
+	Requests    int64  `json:"requests"`
+	Errors      int64  `json:"errors"`
+	CacheHits   int64  `json:"cacheHits"`
+	CacheMisses int64  `json:"cacheMisses"`
+	DriveCalls  int64  `json:"driveCalls"`
+	DriveErrors int64  `json:"driveErrors"`
+	RequestID   string `json:"requestId,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// serveMetrics devuelve los contadores en JSON o, con format=prometheus, en
+// el formato de texto de Prometheus. Solo está disponible si METRICS_TOKEN
+// está configurado y la petición lo envía en el header X-Metrics-Token.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	token := os.Getenv("METRICS_TOKEN")
+	provided := r.Header.Get("X-Metrics-Token")
+	if token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(MetricsResponse{RequestID: requestIDFrom(r.Context()), Error: "Invalid metrics token"})
+		return
+	}
+
+	snapshot := MetricsResponse{
+		Requests:    metrics.requests.Load(),
+		Errors:      metrics.errors.Load(),
+		CacheHits:   metrics.cacheHits.Load(),
+		CacheMisses: metrics.cacheMisses.Load(),
+		DriveCalls:  metrics.driveCalls.Load(),
+		DriveErrors: metrics.driveErrors.Load(),
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if r.URL.Query().Get("format") != "prometheus" {
+		json.NewEncoder(w).Encode(snapshot)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, counter := range []struct {
+		name, help string
+		value      int64
+	}{
+		{"items_requests_total", "Peticiones recibidas.", snapshot.Requests},
+		{"items_errors_total", "Respuestas con status 5xx.", snapshot.Errors},
+		{"items_cache_hits_total", "Lecturas servidas desde el cache.", snapshot.CacheHits},
+		{"items_cache_misses_total", "Lecturas que tuvieron que consultar Drive.", snapshot.CacheMisses},
+		{"items_drive_calls_total", "Llamadas a la API de Drive, incluyendo reintentos.", snapshot.DriveCalls},
+		{"items_drive_errors_total", "Llamadas a la API de Drive que fallaron.", snapshot.DriveErrors},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", counter.name, counter.help, counter.name, counter.name, counter.value)
+	}
+}
+
+// DebugFile es un archivo tal como lo devuelve Drive en el modo debug
+type DebugFile struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	MimeType string `json:"mimeType"`
+}
+
+// DebugResponse es la respuesta del modo debug
+type DebugResponse struct {
+	Files     []DebugFile `json:"files"`
+	RequestID string      `json:"requestId,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	ErrorCode string      `json:"errorCode,omitempty"`
+}
+
+// serveDebug devuelve los archivos de una carpeta sin procesar metadata. Solo
+// está disponible si DEBUG_TOKEN está configurado y la petición lo envía en el
+// header X-Debug-Token.
+func serveDebug(w http.ResponseWriter, r *http.Request, credentialsJSON, folderID string) {
+	token := os.Getenv("DEBUG_TOKEN")
+	provided := r.Header.Get("X-Debug-Token")
+	if token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(DebugResponse{RequestID: requestIDFrom(r.Context()), Error: "Invalid debug token"})
+		return
+	}
+
+	srv, err := getDriveService(r.Context(), credentialsJSON)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(DebugResponse{RequestID: requestIDFrom(r.Context()), Error: fmt.Sprintf("Unable to create Drive client: %v", err)})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout())
+	defer cancel()
+
+	opts := itemOptions{driveID: r.URL.Query().Get("driveId")}
+	query := fmt.Sprintf("'%s' in parents and trashed=false", folderID)
+	fileList, err := listFiles(ctx, srv, query, "files(id, name, mimeType)", opts)
+	if err != nil {
+		status, code, message := classifyDriveError(ctx, fmt.Errorf("error listing files: %w", err))
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(DebugResponse{RequestID: requestIDFrom(r.Context()), Error: message, ErrorCode: code})
+		return
+	}
+
+	files := make([]DebugFile, 0, len(fileList.Files))
+	for _, file := range fileList.Files {
+		files = append(files, DebugFile{ID: file.Id, Name: file.Name, MimeType: file.MimeType})
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(DebugResponse{Files: files})
+}
+
+// ValidationReport es la respuesta del modo validate
+type ValidationReport struct {
+	Valid               bool     `json:"valid"`
+	MetadataFound       bool     `json:"metadataFound"`
+	MetadataFile        string   `json:"metadataFile,omitempty"`
+	MetadataSource      string   `json:"metadataSource,omitempty"`
+	MetadataError       string   `json:"metadataError,omitempty"`
+	ImageCount          int      `json:"imageCount"`
+	MissingRequiredKeys []string `json:"missingRequiredKeys"`
+	RequestID           string   `json:"requestId,omitempty"`
+	Error               string   `json:"error,omitempty"`
+	ErrorCode           string   `json:"errorCode,omitempty"`
+}
+
+// serveValidate revisa una carpeta de item sin armar el Item: si tiene archivo
+// de metadata y se puede leer, cuántas imágenes tiene y qué claves de
+// REQUIRED_FIELDS le faltan. Con METADATA_SHEET_ID la metadata es la fila de
+// la carpeta en la hoja, igual que en getItems. Solo acepta carpetas dentro
+// de la raíz.
+func serveValidate(w http.ResponseWriter, r *http.Request, credentialsJSON, rootFolderID, folderID string) {
+	srv, err := getDriveService(r.Context(), credentialsJSON)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(ValidationReport{RequestID: requestIDFrom(r.Context()), Error: fmt.Sprintf("Unable to create Drive client: %v", err)})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout())
+	defer cancel()
+
+	notFound := func() {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(ValidationReport{RequestID: requestIDFrom(r.Context()), Error: "Folder not found"})
+	}
+	driveError := func(err error) {
+		status, code, message := classifyDriveError(ctx, err)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(ValidationReport{RequestID: requestIDFrom(r.Context()), Error: message, ErrorCode: code})
+	}
+
+	folder, err := withRetry(ctx, srv.Files.Get(folderID).Fields("id, name, mimeType, parents").SupportsAllDrives(true).Context(ctx).Do)
+	if err != nil || folder.MimeType != folderMimeType {
+		notFound()
+		return
+	}
+	inside, err := isUnderFolder(ctx, srv, folder, rootFolderID)
+	if err != nil {
+		driveError(fmt.Errorf("error checking folder location: %w", err))
+		return
+	}
+	if !inside {
+		// No revelar si la carpeta existe fuera de la carpeta raíz
+		notFound()
+		return
+	}
+
+	sheet, err := loadSheetMetadata(ctx, credentialsJSON)
+	if err != nil {
+		driveError(err)
+		return
+	}
+
+	opts := itemOptions{driveID: r.URL.Query().Get("driveId"), lang: strings.ToLower(r.URL.Query().Get("lang"))}
+	query := fmt.Sprintf("'%s' in parents and trashed=false", folderID)
+	fileList, err := listFiles(ctx, srv, query, itemFileFields, opts)
+	if err != nil {
+		driveError(fmt.Errorf("error listing files: %w", err))
+		return
+	}
+
+	report := ValidationReport{MissingRequiredKeys: []string{}}
+	var metadataFile *drive.File
+	var subfolders []*drive.File
+	metadataRankFound := -1
+	names := metadataFileNames(opts.lang)
+	for _, file := range fileList.Files {
+		if file.MimeType == folderMimeType {
+			subfolders = append(subfolders, file)
+			continue
+		}
+		if rank, ok := metadataRank(file, names); ok {
+			if metadataRankFound == -1 || rank < metadataRankFound {
+				metadataFile = file
+				metadataRankFound = rank
+			}
+			continue
+		}
+		if isImage(effectiveMimeType(file)) {
+			report.ImageCount++
+		}
+	}
+
+	if len(subfolders) > 0 {
+		nested, err := collectNestedImages(ctx, srv, subfolders, maxDepth()-1, map[string]bool{folderID: true}, opts)
+		if err != nil {
+			driveError(err)
+			return
+		}
+		report.ImageCount += len(nested)
+	}
+
+	metadata := map[string]string{}
+	if sheet != nil {
+		// Los archivos de metadata se ignoran, como en getItems
+		row, ok := sheet.row(folder.Name)
+		report.MetadataSource = "sheet"
+		report.MetadataFound = ok
+		if ok {
+			metadata = applyKeyAliases(row, metadataKeyAliases(ctx))
+		}
+	} else if metadataFile != nil {
+		report.MetadataFound = true
+		report.MetadataFile = metadataFile.Name
+		report.MetadataSource = "file"
+		metadata, err = readMetadata(ctx, srv, metadataFile.Id, metadataFile.Name, metadataFile.MimeType)
+		if err != nil {
+			report.MetadataError = err.Error()
+			metadata = map[string]string{}
+		}
+		metadata = applyKeyAliases(metadata, metadataKeyAliases(ctx))
+	}
+	for _, field := range requiredFields() {
+		if strings.TrimSpace(metadata[field]) == "" {
+			report.MissingRequiredKeys = append(report.MissingRequiredKeys, field)
+		}
+	}
+
+	report.Valid = report.MetadataFound && report.MetadataError == "" && report.ImageCount > 0 && len(report.MissingRequiredKeys) == 0
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(report)
+}
+
+// serveProxy descarga un archivo de Drive con la cuenta de servicio y lo
+// reenvía al cliente. Solo se sirven archivos que estén dentro de la carpeta raíz.
+func serveProxy(w http.ResponseWriter, r *http.Request, credentialsJSON, rootFolderID, fileID string) {
+	srv, err := getDriveService(r.Context(), credentialsJSON)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: fmt.Sprintf("Unable to create Drive client: %v", err)})
+		return
+	}
+
+	resize, err := parseResizeParams(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout())
+	defer cancel()
+
+	file, err := withRetry(ctx, srv.Files.Get(fileID).Fields("id, name, mimeType, size, modifiedTime, parents").SupportsAllDrives(true).Context(ctx).Do)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "File not found"})
+		return
+	}
+
+	inside, err := isUnderFolder(ctx, srv, file, rootFolderID)
+	if err != nil {
+		writeDriveError(ctx, w, r, fmt.Errorf("error checking file location: %w", err))
+		return
+	}
+	if !inside {
+		// No revelar si el archivo existe fuera de la carpeta raíz
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "File not found"})
+		return
+	}
+
+	mimeType := effectiveMimeType(file)
+	convertible := (mimeType == "image/jpeg" || mimeType == "image/png") && file.Size > 0 && file.Size <= maxWebPSourceBytes
+	// Con w o q se devuelve una versión achicada en el formato original
+	resizing := convertible && resize.active()
+	// Solo los PNG se devuelven como WebP si el cliente lo acepta: nativewebp
+	// genera WebP sin pérdida, que casi nunca es más liviano que un JPEG
+	webpCandidate := convertible && !resizing && mimeType == "image/png"
+	if webpCandidate {
+		w.Header().Add("Vary", "Accept")
+	}
+	variantKey := file.Id + "|" + file.ModifiedTime
+	// Las imágenes que ya se vio que no ganan con WebP se sirven tal cual
+	webp := webpCandidate && acceptsWebP(r) && !webpSkips.has(variantKey)
+	if resizing {
+		variantKey += "|" + resize.key()
+		if data, ok := imageVariants.get(variantKey); ok {
+			writeProxied(w, mimeType, data)
+			return
+		}
+	} else if webp {
+		if data, ok := imageVariants.get(variantKey); ok {
+			writeProxied(w, "image/webp", data)
+			return
+		}
+	}
+
+	resp, err := withRetry(ctx, srv.Files.Get(fileID).SupportsAllDrives(true).Context(ctx).Download)
+	if err != nil {
+		loggerFrom(ctx).Error("unable to download proxied file", "fileId", file.Id, "error", err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "Error downloading file"})
+		return
+	}
+	defer resp.Body.Close()
+
+	if resizing {
+		original, err := io.ReadAll(io.LimitReader(resp.Body, maxWebPSourceBytes+1))
+		if err != nil {
+			loggerFrom(ctx).Error("unable to download proxied file", "fileId", file.Id, "error", err.Error())
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "Error downloading file"})
+			return
+		}
+		data, err := resizeImage(original, mimeType, resize)
+		if err != nil {
+			// Si no se pudo achicar, va el original
+			loggerFrom(ctx).Warn("unable to resize proxied image", "fileId", file.Id, "error", err.Error())
+			writeProxied(w, mimeType, original)
+			return
+		}
+		imageVariants.set(variantKey, data)
+		writeProxied(w, mimeType, data)
+		return
+	}
+
+	if webp {
+		original, err := io.ReadAll(io.LimitReader(resp.Body, maxWebPSourceBytes+1))
+		if err != nil {
+			loggerFrom(ctx).Error("unable to download proxied file", "fileId", file.Id, "error", err.Error())
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "Error downloading file"})
+			return
+		}
+		data, err := encodeWebP(original)
+		if err == nil && len(data) < len(original) {
+			imageVariants.set(variantKey, data)
+			writeProxied(w, "image/webp", data)
+			return
+		}
+		// Si no se pudo convertir o el WebP no es más liviano, va el original y
+		// no se vuelve a intentar
+		if err != nil {
+			loggerFrom(ctx).Warn("unable to convert proxied image to webp", "fileId", file.Id, "error", err.Error())
+		}
+		webpSkips.add(variantKey)
+		writeProxied(w, mimeType, original)
+		return
+	}
+
+	w.Header().Set("Content-Type", mimeType)
+	if file.Size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(file.Size, 10))
+	}
+	w.Header().Set("Cache-Control", cacheControl(86400))
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, resp.Body)
+}
+
+// serveZip envía un zip con los archivos de una carpeta de item, sin la
+// metadata ni las subcarpetas. Cada archivo se descarga de Drive y se escribe
+// en el zip a medida que llega, sin guardarlo entero en memoria. Si una
+// descarga falla a mitad de camino el zip queda sin cerrar, para que el
+// cliente lo vea como inválido en lugar de recibirlo incompleto.
+func serveZip(w http.ResponseWriter, r *http.Request, credentialsJSON, rootFolderID, folderID string) {
+	srv, err := getDriveService(r.Context(), credentialsJSON)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: fmt.Sprintf("Unable to create Drive client: %v", err)})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout())
+	defer cancel()
+
+	notFound := func() {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Response{RequestID: requestIDFrom(r.Context()), Error: "Folder not found"})
+	}
+
+	folder, err := withRetry(ctx, srv.Files.Get(folderID).Fields("id, name, mimeType, parents").SupportsAllDrives(true).Context(ctx).Do)
+	if err != nil || folder.MimeType != folderMimeType {
+		notFound()
+		return
+	}
+	inside, err := isUnderFolder(ctx, srv, folder, rootFolderID)
+	if err != nil {
+		writeDriveError(ctx, w, r, fmt.Errorf("error checking folder location: %w", err))
+		return
+	}
+	if !inside {
+		// No revelar si la carpeta existe fuera de la carpeta raíz
+		notFound()
+		return
+	}
+
+	opts := itemOptions{driveID: r.URL.Query().Get("driveId")}
+	query := fmt.Sprintf("'%s' in parents and trashed=false", folderID)
+	fileList, err := listFiles(ctx, srv, query, "files(id, name, mimeType, modifiedTime)", opts)
+	if err != nil {
+		writeDriveError(ctx, w, r, fmt.Errorf("error listing files: %w", err))
+		return
+	}
+
+	var files []*drive.File
+	for _, file := range fileList.Files {
+		// Las carpetas, accesos directos y archivos nativos de Google no se
+		// pueden descargar tal cual
+		if strings.HasPrefix(file.MimeType, "application/vnd.google-apps.") || isMetadataFile(file) {
+			continue
+		}
+		files = append(files, file)
+	}
+	sortFilesByName(files)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": folder.Name + ".zip"}))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	archive := zip.NewWriter(w)
+	names := make(map[string]bool)
+	for _, file := range files {
+		header := &zip.FileHeader{Name: zipEntryName(file, names), Method: zip.Deflate}
+		// Las imágenes, videos, audios y PDFs ya vienen comprimidos
+		if isMediaFile(file) {
+			header.Method = zip.Store
+		}
+		if modified, err := time.Parse(time.RFC3339, file.ModifiedTime); err == nil {
+			header.Modified = modified
+		}
+
+		if err := copyToZip(ctx, srv, archive, header, file.Id); err != nil {
+			loggerFrom(ctx).Error("error writing zip",
+				"folderId", folderID,
+				"fileId", file.Id,
+				"error", err.Error())
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		loggerFrom(ctx).Error("error closing zip", "folderId", folderID, "error", err.Error())
+	}
+}
+
+// copyToZip descarga un archivo de Drive y lo escribe como entrada del zip
+func copyToZip(ctx context.Context, srv *drive.Service, archive *zip.Writer, header *zip.FileHeader, fileID string) error {
+	resp, err := withRetry(ctx, srv.Files.Get(fileID).SupportsAllDrives(true).Context(ctx).Download)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	entry, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, resp.Body)
+	return err
+}
+
+// zipEntryName devuelve el nombre del archivo dentro del zip. Drive permite
+// nombres repetidos en una carpeta, así que a los siguientes se les agrega el
+// comienzo de su ID.
+func zipEntryName(file *drive.File, used map[string]bool) string {
+	name := strings.ReplaceAll(file.Name, "/", "_")
+	if used[name] {
+		ext := filepath.Ext(name)
+		name = strings.TrimSuffix(name, ext) + "-" + shortID(file.Id) + ext
+	}
+	used[name] = true
+	return name
+}
+
+// isMetadataFile indica si el archivo es de metadata, en el idioma por
+// defecto o en uno localizado (metadata.<lang>.txt)
+func isMetadataFile(file *drive.File) bool {
+	names := metadataFileNames("")
+	if _, ok := metadataRank(file, names); ok {
+		return true
+	}
+	ext := filepath.Ext(file.Name)
+	base := strings.TrimSuffix(file.Name, ext)
+	if i := strings.LastIndex(base, "."); i >= 0 && langPattern.MatchString(strings.ToLower(base[i+1:])) {
+		_, ok := metadataRank(&drive.File{Name: base[:i] + ext, MimeType: file.MimeType}, names)
+		return ok
+	}
+	return false
+}
+
+// writeProxied envía un archivo del proxy que ya está en memoria
+func writeProxied(w http.ResponseWriter, contentType string, data []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Cache-Control", cacheControl(86400))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// maxWebPSourceBytes limita el tamaño de las imágenes que se convierten a WebP
+// para no agotar la memoria de la función
+const maxWebPSourceBytes = 20 << 20
+
+// acceptsWebP indica si Accept incluye image/webp con un q distinto de cero
+func acceptsWebP(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		params := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), "image/webp") {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// encodeWebP decodifica una imagen PNG y la codifica como WebP sin pérdida
+func encodeWebP(original []byte) ([]byte, error) {
+	if err := checkDecodeSize(original); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(original))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := nativewebp.Encode(&buf, img, nil); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// variantCache guarda en memoria las imágenes convertidas, hasta un total de
+// bytes; al superarlo se descartan las más viejas.
+type variantCache struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+	order   []string
+	size    int
+}
+
+var imageVariants = &variantCache{entries: make(map[string][]byte)}
+
+func (c *variantCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.entries[key]
+	return data, ok
+}
+
+// set guarda una variante (WebP o achicada). WEBP_CACHE_BYTES (por defecto
+// 32 MB) es el máximo que ocupan todas juntas; 0 desactiva el cache.
+func (c *variantCache) set(key string, data []byte) {
+	maxBytes := getEnvInt("WEBP_CACHE_BYTES", 32<<20)
+	if len(data) > maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	for c.size+len(data) > maxBytes && len(c.order) > 0 {
+		oldest := c.order[0]
+		c.order = c.order[1:]
+		c.size -= len(c.entries[oldest])
+		delete(c.entries, oldest)
+	}
+	c.entries[key] = data
+	c.order = append(c.order, key)
+	c.size += len(data)
+}
+
+// maxResizeWidth evita pedir anchos absurdos al proxy
+const maxResizeWidth = 4096
+
+// maxDecodePixels limita las imágenes que el proxy decodifica: unos pocos
+// bytes comprimidos pueden declarar dimensiones que no entran en la memoria
+// de la función
+const maxDecodePixels = 50_000_000
+
+// checkDecodeSize lee solo el encabezado de la imagen y rechaza las que
+// superan maxDecodePixels antes de decodificarlas
+func checkDecodeSize(data []byte) error {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if config.Width*config.Height > maxDecodePixels {
+		return fmt.Errorf("image too large to decode (%dx%d)", config.Width, config.Height)
+	}
+	return nil
+}
+
+// maxWebPSkips acota cuántas imágenes recuerda webpSkips
+const maxWebPSkips = 4096
+
+// keySet es un conjunto de claves en memoria que se vacía al llegar a max
+type keySet struct {
+	mu      sync.Mutex
+	entries map[string]bool
+	max     int
+}
+
+// webpSkips recuerda las imágenes cuya conversión a WebP falló o no resultó
+// más liviana, para no volver a decodificarlas en cada petición
+var webpSkips = &keySet{entries: make(map[string]bool), max: maxWebPSkips}
+
+func (s *keySet) has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.entries[key]
+}
+
+func (s *keySet) add(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.entries) >= s.max {
+		s.entries = make(map[string]bool)
+	}
+	s.entries[key] = true
+}
+
+// defaultJPEGQuality es la calidad de los JPEG achicados cuando no se pide q
+const defaultJPEGQuality = 85
+
+// resizeParams son el ancho (w) y la calidad JPEG (q) pedidos al proxy; 0
+// significa que no se pidió
+type resizeParams struct {
+	width   int
+	quality int
+}
+
+// parseResizeParams lee y valida w y q
+func parseResizeParams(query url.Values) (resizeParams, error) {
+	var params resizeParams
+	if raw := query.Get("w"); raw != "" {
+		width, err := strconv.Atoi(raw)
+		if err != nil || width <= 0 || width > maxResizeWidth {
+			return params, fmt.Errorf("w must be between 1 and %d", maxResizeWidth)
+		}
+		params.width = width
+	}
+	if raw := query.Get("q"); raw != "" {
+		quality, err := strconv.Atoi(raw)
+		if err != nil || quality <= 0 || quality > 100 {
+			return params, fmt.Errorf("q must be between 1 and 100")
+		}
+		params.quality = quality
+	}
+	return params, nil
+}
+
+func (p resizeParams) active() bool {
+	return p.width > 0 || p.quality > 0
+}
+
+// key identifica la variante en imageVariants
+func (p resizeParams) key() string {
+	return fmt.Sprintf("w%d-q%d", p.width, p.quality)
+}
+
+// resizeImage achica una imagen JPEG o PNG al ancho pedido manteniendo la
+// proporción (nunca la agranda) y la vuelve a codificar en el mismo formato.
+// La calidad solo se aplica a JPEG.
+func resizeImage(original []byte, mimeType string, params resizeParams) ([]byte, error) {
+	if err := checkDecodeSize(original); err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(original))
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	if params.width > 0 && params.width < bounds.Dx() {
+		height := int(math.Round(float64(bounds.Dy()) * float64(params.width) / float64(bounds.Dx())))
+		resized := image.NewRGBA(image.Rect(0, 0, params.width, max(height, 1)))
+		draw.CatmullRom.Scale(resized, resized.Bounds(), img, bounds, draw.Over, nil)
+		img = resized
+	}
+
+	var buf bytes.Buffer
+	if mimeType == "image/png" {
+		err = png.Encode(&buf, img)
+	} else {
+		quality := params.quality
+		if quality == 0 {
+			quality = defaultJPEGQuality
+		}
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// maxFolderDepth limita cuántos niveles se suben buscando la carpeta raíz
+const maxFolderDepth = 10
+
+// isUnderFolder indica si el archivo está dentro de folderID, subiendo por
+// sus carpetas padre.
+func isUnderFolder(ctx context.Context, srv *drive.Service, file *drive.File, folderID string) (bool, error) {
+	parents := file.Parents
+	visited := make(map[string]bool)
+
+	for depth := 0; depth < maxFolderDepth && len(parents) > 0; depth++ {
+		var next []string
+		for _, parentID := range parents {
+			if parentID == folderID {
+				return true, nil
+			}
+			if visited[parentID] {
+				continue
+			}
+			visited[parentID] = true
+
+			parent, err := withRetry(ctx, srv.Files.Get(parentID).Fields("id, parents").SupportsAllDrives(true).Context(ctx).Do)
+			if err != nil {
+				// Sin acceso a la carpeta padre: no está dentro de la raíz compartida
+				if isNotFound(err) {
+					continue
+				}
+				return false, err
+			}
+			next = append(next, parent.Parents...)
+		}
+		parents = next
+	}
+	return false, nil
+}
+
+// isNotFound indica si Drive respondió 404
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// tokenBucket guarda los tokens disponibles de un cliente
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// ipRateLimiter limita las peticiones por IP con un token bucket. El estado
+// vive en memoria mientras el contenedor siga caliente.
+type ipRateLimiter struct {
+	mu          sync.Mutex
+	buckets     map[string]*tokenBucket
+	lastCleanup time.Time
+}
+
+var rateLimiter = &ipRateLimiter{buckets: make(map[string]*tokenBucket)}
+
+// allow consume un token del cliente. Si no hay, devuelve false y cuánto
+// esperar hasta el próximo. Se configura con RATE_LIMIT (peticiones por
+// minuto, 0 o sin definir lo desactiva) y RATE_BURST (por defecto 10).
+func (l *ipRateLimiter) allow(ip string, now time.Time) (bool, time.Duration) {
+	perMinute := getEnvInt("RATE_LIMIT", 0)
+	if perMinute <= 0 {
+		return true, 0
+	}
+	burst := float64(getEnvInt("RATE_BURST", 10))
+	if burst < 1 {
+		burst = 1
+	}
+	rate := float64(perMinute) / 60
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Cada minuto se borran los clientes que ya recuperaron todos sus tokens
+	if now.Sub(l.lastCleanup) > time.Minute {
+		for key, bucket := range l.buckets {
+			if bucket.tokens+now.Sub(bucket.lastSeen).Seconds()*rate >= burst {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastCleanup = now
+	}
+
+	bucket, ok := l.buckets[ip]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, lastSeen: now}
+		l.buckets[ip] = bucket
+	}
+
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.lastSeen).Seconds()*rate)
+	bucket.lastSeen = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// clientIP obtiene la IP del cliente: la primera de X-Forwarded-For (que
+// completa Vercel) o, si no está, la de la conexión.
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// allowedOrigin decide el valor de Access-Control-Allow-Origin. Sin
+// ALLOWED_ORIGINS se permite cualquier origen; con la lista configurada se
+// devuelve el Origin de la petición si está permitido, o el primero de la lista.
+func allowedOrigin(r *http.Request, w http.ResponseWriter) string {
+	origins := parseList(os.Getenv("ALLOWED_ORIGINS"))
+	if len(origins) == 0 {
+		return "*"
+	}
+
+	// La respuesta depende del Origin, los caches no deben mezclarlas
+	w.Header().Add("Vary", "Origin")
+
+	origin := r.Header.Get("Origin")
+	for _, allowed := range origins {
+		if strings.EqualFold(origin, allowed) {
+			return origin
+		}
+	}
+	return origins[0]
+}
+
+// itemOptions agrupa los parámetros de la petición que cambian cómo se leen
+// las carpetas en Drive.
+type itemOptions struct {
+	// driveID limita las búsquedas a una unidad compartida concreta
+	driveID string
+	// grouped trata las carpetas que solo tienen subcarpetas como categorías
+	grouped bool
+	// urlMode elige el formato de las URLs de imágenes: view (por defecto),
+	// thumbnail o download
+	urlMode string
+	// videoURLMode elige el formato de las URLs de videos: preview (por
+	// defecto, el reproductor embebible de Drive) o download
+	videoURLMode string
+	// thumbSize es el lado mayor, en píxeles, de las miniaturas en Thumbnails
+	thumbSize int
+	// lang prefiere los archivos de metadata localizados (metadata.<lang>.txt)
+	lang string
+	// maxImages limita cuántas imágenes se devuelven por item (0 = sin límite)
+	maxImages int
+	// pageToken y pageSize eligen la página del listado de carpetas de la raíz
+	pageToken string
+	pageSize  int64
+	// recent procesa solo las N carpetas modificadas más recientemente (0 = todas)
+	recent int
+	// blurPreview incrusta en cada imagen una miniatura diminuta en base64
+	blurPreview bool
+	// modifiedSince limita las carpetas de items a las modificadas después de
+	// ese momento (RFC 3339 en UTC, "" = todas)
+	modifiedSince string
+	// sheet es la metadata leída de METADATA_SHEET_ID (nil si no se usa). No
+	// forma parte de cacheKey porque depende solo del entorno.
+	sheet *sheetMetadata
+	// httpClient es el cliente autenticado para las miniaturas de blurPreview.
+	// Tampoco forma parte de cacheKey.
+	httpClient *http.Client
+}
+
+// cacheKey identifica en el cache el resultado de una carpeta raíz con estas opciones
+func (o itemOptions) cacheKey(rootFolderID string) string {
+	return fmt.Sprintf("%s|%s|%t|%s|%s|%d|%s|%d|%s|%d|%d|%t|%s", rootFolderID, o.driveID, o.grouped, o.urlMode, o.videoURLMode, o.thumbSize, o.lang, o.maxImages, o.pageToken, o.pageSize, o.recent, o.blurPreview, o.modifiedSince)
+}
+
+// listFiles lista archivos incluyendo las unidades compartidas. Sin driveID
+// busca en todas las unidades accesibles, lo que sigue funcionando para
+// carpetas de "Mi unidad".
+func listFiles(ctx context.Context, srv *drive.Service, query, fields string, opts itemOptions) (*drive.FileList, error) {
+	return listFilesPage(ctx, srv, query, fields, opts, "", 0, "")
+}
+
+// listFilesPage es como listFiles pero pide una página concreta: pageToken es
+// el nextPageToken de la anterior ("" para la primera) y pageSize 0 usa el
+// tamaño por defecto de Drive. orderBy ("" para el orden de Drive) se pasa tal
+// cual a Files.List.
+func listFilesPage(ctx context.Context, srv *drive.Service, query, fields string, opts itemOptions, pageToken string, pageSize int64, orderBy string) (fileList *drive.FileList, err error) {
+	ctx, span := tracer.Start(ctx, "drive.Files.List", trace.WithAttributes(attribute.String("drive.query", query)))
+	defer func() { endSpan(span, err) }()
+
+	call := srv.Files.List().
+		Q(query).
+		Fields(googleapi.Field(fields)).
+		SupportsAllDrives(true).
+		IncludeItemsFromAllDrives(true).
+		Context(ctx)
+	if pageToken != "" {
+		call = call.PageToken(pageToken)
+	}
+	if pageSize > 0 {
+		call = call.PageSize(pageSize)
+	}
+	if orderBy != "" {
+		call = call.OrderBy(orderBy)
+	}
+	if opts.driveID != "" {
+		call = call.Corpora("drive").DriveId(opts.driveID)
+	} else {
+		call = call.Corpora("allDrives")
+	}
+	return withRetry(ctx, call.Do)
+}
+
+// listAllFiles es como listFiles pero sigue nextPageToken hasta leer todas
+// las páginas. fields son los campos de cada archivo, sin "files(...)".
+func listAllFiles(ctx context.Context, srv *drive.Service, query, fields string, opts itemOptions) ([]*drive.File, error) {
+	var files []*drive.File
+	pageToken := ""
+	for {
+		fileList, err := listFilesPage(ctx, srv, query, "nextPageToken, files("+fields+")", opts, pageToken, maxDrivePageSize, "")
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, fileList.Files...)
+		if fileList.NextPageToken == "" {
+			return files, nil
+		}
+		pageToken = fileList.NextPageToken
+	}
+}
+
+// driveClient guarda los servicios de Drive y Sheets construidos a partir de
+// unas credenciales.
+type driveClient struct {
+	once        sync.Once
+	credentials string
+	srv         *drive.Service
+	sheets      *sheets.Service
+	// httpClient hace peticiones autenticadas fuera de la API, como bajar
+	// los thumbnailLink de archivos que no son públicos
+	httpClient *http.Client
+	err        error
+}
+
+var (
+	driveClientMu sync.Mutex
+	cachedClient  *driveClient
+)
+
+// errCredentialsMisconfigured es el error que ve el cliente cuando las
+// credenciales no sirven; el detalle queda solo en los logs.
+var errCredentialsMisconfigured = errors.New("credentials misconfigured")
+
+// getClient reutiliza los clientes de Drive y Sheets entre invocaciones
+// mientras el contenedor siga caliente. Si las credenciales cambian se
+// construyen unos nuevos.
+func getClient(ctx context.Context, credentialsJSON string) (*driveClient, error) {
+	driveClientMu.Lock()
+	client := cachedClient
+	if client == nil || client.credentials != credentialsJSON {
+		client = &driveClient{credentials: credentialsJSON}
+		cachedClient = client
+	}
+	driveClientMu.Unlock()
+
+	client.once.Do(func() {
+		// Validar el JSON antes: el error de NewService es críptico y puede
+		// incluir partes de las credenciales, así que solo va a los logs
+		var parsed map[string]interface{}
+		if err := json.Unmarshal([]byte(credentialsJSON), &parsed); err != nil {
+			loggerFrom(ctx).Error("invalid GOOGLE_CREDENTIALS_JSON", "error", err.Error())
+			client.err = errCredentialsMisconfigured
+			return
+		}
+
+		// El servicio vive más que la petición, por eso no usa su contexto
+		client.srv, client.err = drive.NewService(context.Background(), option.WithCredentialsJSON([]byte(credentialsJSON)))
+		if client.err != nil {
+			loggerFrom(ctx).Error("unable to create Drive client", "error", client.err.Error())
+			client.err = errCredentialsMisconfigured
+		}
+		if client.err == nil {
+			client.sheets, client.err = sheets.NewService(context.Background(),
+				option.WithCredentialsJSON([]byte(credentialsJSON)),
+				option.WithScopes(sheets.SpreadsheetsReadonlyScope))
+			if client.err != nil {
+				loggerFrom(ctx).Error("unable to create Sheets client", "error", client.err.Error())
+				client.err = errCredentialsMisconfigured
+			}
+		}
+		if client.err == nil {
+			client.httpClient, _, client.err = htransport.NewClient(context.Background(),
+				option.WithCredentialsJSON([]byte(credentialsJSON)),
+				option.WithScopes(drive.DriveReadonlyScope))
+			if client.err != nil {
+				loggerFrom(ctx).Error("unable to create authenticated HTTP client", "error", client.err.Error())
+				client.err = errCredentialsMisconfigured
+			}
+		}
+	})
+
+	if client.err != nil {
+		// No cachear errores: la próxima petición vuelve a intentarlo
+		driveClientMu.Lock()
+		if cachedClient == client {
+			cachedClient = nil
+		}
+		driveClientMu.Unlock()
+		return nil, client.err
+	}
+	return client, nil
+}
+
+// getDriveService devuelve el drive.Service del cliente compartido
+func getDriveService(ctx context.Context, credentialsJSON string) (*drive.Service, error) {
+	client, err := getClient(ctx, credentialsJSON)
+	if err != nil {
+		return nil, err
+	}
+	return client.srv, nil
+}
+
+// getHTTPClient devuelve un cliente HTTP autenticado con el Service Account
+func getHTTPClient(ctx context.Context, credentialsJSON string) (*http.Client, error) {
+	client, err := getClient(ctx, credentialsJSON)
+	if err != nil {
+		return nil, err
+	}
+	return client.httpClient, nil
+}
+
+// withRetry ejecuta una llamada a Drive reintentando con backoff exponencial
+// y jitter cuando el error es transitorio (429, 5xx o rate limit). Los errores
+// definitivos, como 403 por permisos o 404, se devuelven de inmediato.
+func withRetry[T any](ctx context.Context, call func(...googleapi.CallOption) (T, error)) (T, error) {
+	maxRetries := getEnvInt("RETRY_MAX", 3)
+	backoff := 200 * time.Millisecond
+
+	for attempt := 0; ; attempt++ {
+		metrics.driveCalls.Add(1)
+		result, err := call()
+		if err != nil {
+			metrics.driveErrors.Add(1)
+		}
+		if err == nil || attempt >= maxRetries || !isRetryable(err) {
+			return result, err
+		}
+
+		jitter := time.Duration(mathrand.Int63n(int64(backoff)))
+		select {
+		case <-time.After(backoff + jitter):
+		case <-ctx.Done():
+			return result, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// isRetryable indica si un error de Drive vale la pena reintentarlo
+func isRetryable(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= 500 {
+		return true
+	}
+	// Drive también informa los límites de cuota como 403
+	if apiErr.Code == http.StatusForbidden {
+		for _, e := range apiErr.Errors {
+			if e.Reason == "rateLimitExceeded" || e.Reason == "userRateLimitExceeded" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// folderResult es el resultado de procesar una carpeta de item
+type folderResult struct {
+	item Item
+	err  error
+}
+
+// itemsResult es lo que se obtiene de leer una carpeta raíz
+type itemsResult struct {
+	items []Item
+	// version resume las carpetas y su metadata (usada para el ETag)
+	version string
+	// warnings describe las carpetas que no se pudieron procesar
+	warnings []string
+	// lastModified es el modifiedTime más reciente de las carpetas
+	lastModified time.Time
+	// nextPageToken es el cursor de Drive para la página siguiente de carpetas
+	nextPageToken string
+	// meta es la metadata de la carpeta raíz (nil si no tiene)
+	meta *Meta
+	// truncated indica que se procesaron solo las primeras MAX_ITEMS carpetas
+	truncated bool
+}
+
+// getItems devuelve los items de la carpeta raíz junto con una versión que
+// resume sus carpetas y su metadata (usada para el ETag).
+func getItems(ctx context.Context, srv *drive.Service, rootFolderID string, opts itemOptions) (result itemsResult, err error) {
+	ctx, span := tracer.Start(ctx, "getItems", trace.WithAttributes(attribute.String("drive.folder_id", rootFolderID)))
+	defer func() { endSpan(span, err) }()
+
+	page, err := listItemFolders(ctx, srv, rootFolderID, opts)
+	if err != nil {
+		return itemsResult{}, err
+	}
+	result.truncated = truncateFolders(ctx, &page)
+	folders := page.folders
+	rootMeta := fetchRootMeta(ctx, srv, rootFolderID, opts)
+
+	results := make([]folderResult, len(folders))
+	processFolders(ctx, srv, folders, page.categories, opts, func(i int, res folderResult) {
+		results[i] = res
+	})
+
+	if err := ctx.Err(); err != nil {
+		return itemsResult{}, err
+	}
+
+	result.items, result.warnings = collectResults(ctx, results, folders)
+	result.meta, result.warnings = collectRootMeta(ctx, rootMeta, result.warnings)
+	result.version = resultVersion(folders, result.items, opts)
+	result.lastModified = latestModified(folders)
+	result.nextPageToken = page.nextPageToken
+	return result, nil
+}
+
+// collectResults asigna los slugs y junta los items procesados, avisando en
+// warnings las carpetas que fallaron. Lo usan getItems y streamItems para que
+// el cache quede igual sin importar cuál lo llenó.
+func collectResults(ctx context.Context, results []folderResult, folders []*drive.File) ([]Item, []string) {
+	assignSlugs(results, folders)
+
+	var items []Item
+	var warnings []string
+	for i, res := range results {
+		if res.err != nil {
+			// Log y avisar al cliente, pero continuar con los demás items
+			loggerFrom(ctx).Error("error processing folder",
+				"folderId", folders[i].Id,
+				"folderName", folders[i].Name,
+				"error", res.err.Error())
+			warnings = append(warnings,
+				fmt.Sprintf("folder %s (%s) skipped: %v", folders[i].Name, folders[i].Id, res.err))
+			continue
+		}
+		items = append(items, res.item)
+	}
+	return items, warnings
+}
+
+// maxItems lee MAX_ITEMS: cuántas carpetas de items se procesan como máximo
+// por petición. 0, el valor por defecto, no pone límite.
+func maxItems() int {
+	return getEnvInt("MAX_ITEMS", 0)
+}
+
+// truncateFolders deja solo las primeras MAX_ITEMS carpetas de la página e
+// indica si sobraban, para no procesar miles de carpetas si la raíz apunta
+// por error a una unidad enorme. El nextPageToken de Drive saltearía las
+// carpetas descartadas, así que también se quita.
+func truncateFolders(ctx context.Context, page *folderPage) bool {
+	limit := maxItems()
+	if limit == 0 || len(page.folders) <= limit {
+		return false
+	}
+	loggerFrom(ctx).Warn("too many item folders, truncating",
+		"folders", len(page.folders),
+		"maxItems", limit)
+	page.folders = page.folders[:limit]
+	page.categories = page.categories[:limit]
+	page.nextPageToken = ""
+	return true
+}
+
+// rootMetaResult es el resultado de leer la metadata de la carpeta raíz
+type rootMetaResult struct {
+	meta *Meta
+	err  error
+}
+
+// fetchRootMeta lee en segundo plano la metadata de la carpeta raíz, mientras
+// se procesan los items.
+func fetchRootMeta(ctx context.Context, srv *drive.Service, rootFolderID string, opts itemOptions) <-chan rootMetaResult {
+	done := make(chan rootMetaResult, 1)
+	go func() {
+		meta, err := readRootMeta(ctx, srv, rootFolderID, opts)
+		done <- rootMetaResult{meta: meta, err: err}
+	}()
+	return done
+}
+
+// collectRootMeta espera la metadata de la raíz. Si no se pudo leer se avisa
+// en warnings sin descartar los items.
+func collectRootMeta(ctx context.Context, done <-chan rootMetaResult, warnings []string) (*Meta, []string) {
+	res := <-done
+	if res.err != nil {
+		loggerFrom(ctx).Error("error reading root metadata", "error", res.err.Error())
+		return nil, append(warnings, fmt.Sprintf("root metadata skipped: %v", res.err))
+	}
+	return res.meta, warnings
+}
+
+// readRootMeta busca un archivo de metadata (con los mismos nombres que en los
+// items) directamente en la carpeta raíz. Devuelve nil si no hay ninguno.
+func readRootMeta(ctx context.Context, srv *drive.Service, rootFolderID string, opts itemOptions) (*Meta, error) {
+	query := fmt.Sprintf("'%s' in parents and mimeType!='%s' and trashed=false", rootFolderID, folderMimeType)
+	fileList, err := listFiles(ctx, srv, query, "files(id, name, mimeType)", opts)
+	if err != nil {
+		return nil, fmt.Errorf("error listing root files: %w", err)
+	}
+
+	var best *drive.File
+	bestRank := -1
+	names := metadataFileNames(opts.lang)
+	for _, file := range fileList.Files {
+		if rank, ok := metadataRank(file, names); ok && (bestRank == -1 || rank < bestRank) {
+			best = file
+			bestRank = rank
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+
+	metadata, err := readMetadata(ctx, srv, best.Id, best.Name, best.MimeType)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata: %v", err)
+	}
+	metadata = applyKeyAliases(metadata, metadataKeyAliases(ctx))
+
+	meta := &Meta{Title: metadata["title"], Description: metadata["description"]}
+	for key, value := range metadata {
+		if key == "title" || key == "description" {
+			continue
+		}
+		if meta.Extra == nil {
+			meta.Extra = make(map[string]string)
+		}
+		meta.Extra[key] = value
+	}
+	return meta, nil
+}
+
+// processFolders procesa las carpetas (cada item) en paralelo con un pool
+// acotado. emit recibe cada resultado en el orden de las carpetas, apenas están
+// listos ese resultado y todos los anteriores; las llamadas no se solapan.
+// El contenido de las carpetas se lista de a grupos de childrenBatchSize.
+func processFolders(ctx context.Context, srv *drive.Service, folders []*drive.File, categories []string, opts itemOptions, emit func(int, folderResult)) {
+	batches := make([]*childrenBatch, (len(folders)+childrenBatchSize-1)/childrenBatchSize)
+	for b := range batches {
+		end := min((b+1)*childrenBatchSize, len(folders))
+		batches[b] = &childrenBatch{folders: folders[b*childrenBatchSize : end]}
+	}
+
+	results := make([]folderResult, len(folders))
+	done := make([]bool, len(folders))
+	next := 0
+	var mu sync.Mutex
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				item, err := processItemFolder(ctx, srv, folders[i].Id, folders[i].Name, batches[i/childrenBatchSize], opts)
+				// Drive devuelve los timestamps en RFC3339
+				item.CreatedAt = folders[i].CreatedTime
+				item.UpdatedAt = folders[i].ModifiedTime
+				item.Category = categories[i]
+
+				mu.Lock()
+				results[i] = folderResult{item: item, err: err}
+				done[i] = true
+				for next < len(folders) && done[next] {
+					emit(next, results[next])
+					next++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for i := range folders {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// childrenBatchSize es cuántas carpetas de items se listan juntas, con un solo
+// Files.List "'a' in parents or 'b' in parents ...", en lugar de una consulta
+// por carpeta.
+const childrenBatchSize = 25
+
+// childrenBatch es el contenido de un grupo de carpetas de items. Se lista una
+// sola vez: el primer worker que lo necesita hace la consulta y los demás la
+// esperan. Si la consulta del grupo falla, cada carpeta se lista por separado,
+// para que una carpeta sin acceso no descarte a las demás.
+type childrenBatch struct {
+	once    sync.Once
+	folders []*drive.File
+	files   map[string][]*drive.File
+	err     error
+}
+
+// get devuelve los archivos que cuelgan de folderID
+func (b *childrenBatch) get(ctx context.Context, srv *drive.Service, folderID string, opts itemOptions) ([]*drive.File, error) {
+	b.once.Do(func() {
+		b.files, b.err = listChildren(ctx, srv, b.folders, opts)
+		if b.err != nil && len(b.folders) > 1 {
+			loggerFrom(ctx).Warn("batched folder listing failed, listing folders one by one",
+				"folders", len(b.folders),
+				"error", b.err.Error())
+		}
+	})
+	if b.err != nil && len(b.folders) > 1 {
+		query := fmt.Sprintf("'%s' in parents and trashed=false", folderID)
+		return listAllFiles(ctx, srv, query, itemFileFieldList, opts)
+	}
+	return b.files[folderID], b.err
+}
+
+// listChildren lista los archivos de varias carpetas en una consulta (con
+// todas sus páginas) y los agrupa por carpeta según parents.
+func listChildren(ctx context.Context, srv *drive.Service, folders []*drive.File, opts itemOptions) (map[string][]*drive.File, error) {
+	conditions := make([]string, len(folders))
+	children := make(map[string][]*drive.File, len(folders))
+	for i, folder := range folders {
+		conditions[i] = fmt.Sprintf("'%s' in parents", folder.Id)
+		children[folder.Id] = nil
+	}
+	query := fmt.Sprintf("(%s) and trashed=false", strings.Join(conditions, " or "))
+	files, err := listAllFiles(ctx, srv, query, itemFileFieldList+", parents", opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		for _, parent := range file.Parents {
+			if _, ok := children[parent]; ok {
+				children[parent] = append(children[parent], file)
+			}
+		}
+	}
+	return children, nil
+}
+
+// folderPage son las carpetas de items de una página del listado de la raíz
+type folderPage struct {
+	folders []*drive.File
+	// categories tiene la categoría de cada carpeta ("" si no se agrupan o
+	// cuelga directamente de la raíz)
+	categories []string
+	// nextPageToken permite pedir la página siguiente ("" si es la última)
+	nextPageToken string
+}
+
+// listItemFolders lista las carpetas de items de la página de la raíz que
+// indican opts.pageToken y opts.pageSize.
+func listItemFolders(ctx context.Context, srv *drive.Service, rootFolderID string, opts itemOptions) (folderPage, error) {
+	query := fmt.Sprintf("'%s' in parents and mimeType='%s' and trashed=false", rootFolderID, folderMimeType)
+	if opts.modifiedSince != "" {
+		query += fmt.Sprintf(" and modifiedTime > '%s'", opts.modifiedSince)
+	}
+	if opts.recent > 0 {
+		return listRecentFolders(ctx, srv, query, opts)
+	}
+	// Drive no garantiza el orden entre llamadas: se le pide por nombre para
+	// que las páginas sean estables y después se ordena cada página
+	folderList, err := listFilesPage(ctx, srv, query, "nextPageToken, files(id, name, createdTime, modifiedTime)", opts, opts.pageToken, opts.pageSize, "name")
+	if err != nil {
+		return folderPage{}, fmt.Errorf("error listing folders: %w", err)
+	}
+
+	page := folderPage{folders: visibleFolders(folderList.Files), nextPageToken: folderList.NextPageToken}
+	sortFoldersStable(page.folders)
+	if opts.grouped {
+		page.folders, page.categories, err = expandCategories(ctx, srv, page.folders, opts)
+		if err != nil {
+			return folderPage{}, err
+		}
+		return page, nil
+	}
+	page.categories = make([]string, len(page.folders))
+	return page, nil
+}
+
+// listRecentFolders pide las carpetas de items de la más a la menos recién
+// modificada y se queda con las primeras opts.recent visibles, sin listar el
+// resto de la raíz.
+func listRecentFolders(ctx context.Context, srv *drive.Service, query string, opts itemOptions) (folderPage, error) {
+	var folders []*drive.File
+	pageToken := ""
+	for {
+		folderList, err := listFilesPage(ctx, srv, query, "nextPageToken, files(id, name, createdTime, modifiedTime)", opts, pageToken, int64(min(opts.recent, maxDrivePageSize)), "modifiedTime desc")
+		if err != nil {
+			return folderPage{}, fmt.Errorf("error listing folders: %w", err)
+		}
+		folders = append(folders, visibleFolders(folderList.Files)...)
+		// Las carpetas ocultas no cuentan, así que puede hacer falta otra página
+		if len(folders) >= opts.recent || folderList.NextPageToken == "" {
+			break
+		}
+		pageToken = folderList.NextPageToken
+	}
+
+	if len(folders) > opts.recent {
+		folders = folders[:opts.recent]
+	}
+	return folderPage{folders: folders, categories: make([]string, len(folders))}, nil
+}
+
+// visibleFolders quita las carpetas ocultas: las que empiezan con alguno de
+// los prefijos de HIDDEN_FOLDER_PREFIXES (separados por comas, por defecto
+// "." y "_"), como "_borradores" o ".archivo".
+func visibleFolders(folders []*drive.File) []*drive.File {
+	prefixes := parseList(os.Getenv("HIDDEN_FOLDER_PREFIXES"))
+	if len(prefixes) == 0 {
+		prefixes = []string{".", "_"}
+	}
+
+	var visible []*drive.File
+	for _, folder := range folders {
+		hidden := false
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(folder.Name, prefix) {
+				hidden = true
+				break
+			}
+		}
+		if !hidden {
+			visible = append(visible, folder)
+		}
+	}
+	return visible
+}
+
+// assignSlugs calcula el slug de cada item a partir de su título, en el orden
+// de las carpetas y con las mismas reglas que el modo stream (ver uniqueSlug).
+func assignSlugs(results []folderResult, folders []*drive.File) {
+	seen := make(map[string]bool)
+	for i := range results {
+		if results[i].err != nil {
+			continue
+		}
+		results[i].item.Slug = uniqueSlug(seen, results[i].item.Title, folders[i].Id)
+	}
+}
+
+// uniqueSlug devuelve el slug del título. Si un item anterior ya lo usó, se le
+// agrega el comienzo del ID de la carpeta, así que el primero conserva el slug
+// sin sufijo. seen acumula los slugs ya entregados.
+func uniqueSlug(seen map[string]bool, title, folderID string) string {
+	slug := slugify(title)
+	if seen[slug] {
+		slug += "-" + slugify(shortID(folderID))
+	}
+	seen[slug] = true
+	return slug
+}
+
+// shortID devuelve los primeros caracteres de un ID de Drive
+func shortID(id string) string {
+	if len(id) > 6 {
+		return id[:6]
+	}
+	return id
+}
+
+// slugify convierte un título en un slug para URLs ("Jarrón Rojo" -> "jarron-rojo")
+func slugify(title string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range foldText(title) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+
+	slug := strings.TrimSuffix(b.String(), "-")
+	if slug == "" {
+		return "item"
+	}
+	return slug
+}
+
+// expandCategories reemplaza cada carpeta que solo contiene subcarpetas (una
+// categoría) por esas subcarpetas, devolviendo en paralelo el nombre de la
+// categoría de cada carpeta de item ("" si cuelga directamente de la raíz).
+func expandCategories(ctx context.Context, srv *drive.Service, folders []*drive.File, opts itemOptions) ([]*drive.File, []string, error) {
+	var itemFolders []*drive.File
+	var categories []string
+
+	for _, folder := range folders {
+		query := fmt.Sprintf("'%s' in parents and trashed=false", folder.Id)
+		children, err := listFiles(ctx, srv, query, "files(id, name, mimeType, createdTime, modifiedTime)", opts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error listing category %s: %w", folder.Name, err)
+		}
+
+		onlyFolders := len(children.Files) > 0
+		for _, child := range children.Files {
+			if child.MimeType != folderMimeType {
+				onlyFolders = false
+				break
+			}
+		}
+
+		if !onlyFolders {
+			itemFolders = append(itemFolders, folder)
+			categories = append(categories, "")
+			continue
+		}
+		sortFoldersStable(children.Files)
+		for _, child := range children.Files {
+			itemFolders = append(itemFolders, child)
+			categories = append(categories, folder.Name)
+		}
+	}
+
+	return itemFolders, categories, nil
+}
+
+// sortItems devuelve una copia de los items ordenada por UpdatedAt, de más
+// nuevo a más viejo ("newest") o al revés ("oldest"). Los items sin fecha
+// quedan siempre al final.
+func sortItems(items []Item, order string) []Item {
+	sorted := make([]Item, len(items))
+	copy(sorted, items)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ti, okI := parseItemTime(sorted[i].UpdatedAt)
+		tj, okJ := parseItemTime(sorted[j].UpdatedAt)
+		if !okI || !okJ {
+			return okI && !okJ
+		}
+		if order == "oldest" {
+			return ti.Before(tj)
+		}
+		return ti.After(tj)
+	})
+	return sorted
+}
+
+// parseItemTime interpreta un timestamp RFC3339 de Drive
+func parseItemTime(value string) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339, value)
+	return t, err == nil
+}
+
+// latestModified devuelve el modifiedTime más reciente de las carpetas
+func latestModified(folders []*drive.File) time.Time {
+	var latest time.Time
+	for _, folder := range folders {
+		if t, ok := parseItemTime(folder.ModifiedTime); ok && t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+// resultVersion resume en un hash los IDs y modifiedTime de las carpetas, los
+// items tal como se codifican en JSON y la fecha de la hoja de metadata. Drive
+// no cambia el modifiedTime de una carpeta cuando se agrega, quita o edita un
+// archivo de adentro (una imagen, metadata.txt), por eso los items entran
+// enteros.
+func resultVersion(folders []*drive.File, items []Item, opts itemOptions) string {
+	h := sha256.New()
+	for _, folder := range folders {
+		fmt.Fprintf(h, "%s|%s\n", folder.Id, folder.ModifiedTime)
+	}
+	json.NewEncoder(h).Encode(items)
+	if opts.sheet != nil {
+		fmt.Fprintf(h, "sheet|%s\n", opts.sheet.modifiedTime)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// requestTimeout lee REQUEST_TIMEOUT_SECONDS (por defecto 25): tiempo máximo
+// para armar la respuesta consultando a Drive.
+func requestTimeout() time.Duration {
+	seconds := getEnvInt("REQUEST_TIMEOUT_SECONDS", 25)
+	if seconds < 1 {
+		seconds = 25
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// concurrency lee CONCURRENCY (por defecto 8): cuántas carpetas se procesan a la vez.
+func concurrency() int {
+	n := getEnvInt("CONCURRENCY", 8)
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+func processItemFolder(ctx context.Context, srv *drive.Service, folderID, folderName string, children *childrenBatch, opts itemOptions) (item Item, err error) {
+	ctx, span := tracer.Start(ctx, "processItemFolder", trace.WithAttributes(
+		attribute.String("drive.folder_id", folderID),
+		attribute.String("drive.folder_name", folderName)))
+	defer func() { endSpan(span, err) }()
+
+	item = Item{
+		ImageURLs:  []string{},
+		Thumbnails: []string{},
+		Images:     []Image{},
+		VideoURLs:  []string{},
+		Videos:     []Video{},
+		AudioURLs:  []string{},
+		Documents:  []string{},
+	}
+
+	// Listar todos los archivos en la carpeta del item (junto con las demás
+	// carpetas de su grupo)
+	files, err := children.get(ctx, srv, folderID, opts)
+	if err != nil {
+		return item, fmt.Errorf("error listing files in folder: %v", err)
+	}
+
+	var metadataFileID string
+	var metadataFileName string
+	var metadataMimeType string
+	metadataFileRank := -1
+	metadataNames := metadataFileNames(opts.lang)
+	var images, videos, audios, documents, subfolders []*drive.File
+
+	for _, file := range resolveShortcuts(ctx, srv, files, &item) {
+		// Las subcarpetas solo aportan imágenes (ej. "frente", "detalle")
+		if file.MimeType == folderMimeType {
+			subfolders = append(subfolders, file)
+			continue
+		}
+
+		// Si es un archivo de metadata (metadata.json, .txt o .docx por defecto),
+		// quedarse con el de mayor prioridad
+		if rank, ok := metadataRank(file, metadataNames); ok {
+			if metadataFileRank == -1 || rank < metadataFileRank {
+				metadataFileID = file.Id
+				metadataFileName = file.Name
+				metadataMimeType = file.MimeType
+				metadataFileRank = rank
+			}
+			continue
+		}
+
+		mimeType := effectiveMimeType(file)
+
+		// Si es una imagen
+		if isImage(mimeType) {
+			images = append(images, file)
+		}
+
+		// Si es un video
+		if isVideo(mimeType) {
+			videos = append(videos, file)
+		}
+
+		// Si es un audio
+		if isAudio(mimeType) {
+			audios = append(audios, file)
+		}
+
+		// Si es un documento (PDF)
+		if isDocument(mimeType) {
+			documents = append(documents, file)
+		}
+	}
+
+	// Descargar la metadata en paralelo con el recorrido de las subcarpetas,
+	// que son llamadas independientes a Drive. Con METADATA_SHEET_ID la
+	// metadata es la fila de la carpeta en la hoja y los archivos se ignoran.
+	hasMetadata := metadataFileID != ""
+	metadataDone := make(chan metadataResult, 1)
+	if opts.sheet != nil {
+		row, ok := opts.sheet.row(folderName)
+		hasMetadata = ok
+		metadataFileName = ""
+		metadataDone <- metadataResult{metadata: row}
+	} else if hasMetadata {
+		go func() {
+			metadata, err := readMetadata(ctx, srv, metadataFileID, metadataFileName, metadataMimeType)
+			metadataDone <- metadataResult{metadata: metadata, err: err}
+		}()
+	}
+
+	// Ordenar por nombre para que image2 quede antes que image10
+	sortFilesByName(images)
+	sortFilesByName(videos)
+	sortFilesByName(audios)
+	sortFilesByName(documents)
+
+	// Agregar las imágenes de las subcarpetas después de las propias
+	if len(subfolders) > 0 {
+		visited := map[string]bool{folderID: true}
+		nested, err := collectNestedImages(ctx, srv, subfolders, maxDepth()-1, visited, opts)
+		if err != nil {
+			return item, err
+		}
+		images = append(images, nested...)
+	}
+
+	// Leer metadata.txt o metadata.docx si existe
+	metadata := map[string]string{}
+	if hasMetadata {
+		res := <-metadataDone
+		if errors.Is(res.err, errMetadataTooLarge) {
+			// Un archivo demasiado grande no descarta el item, queda sin metadata
+			item.Warnings = append(item.Warnings, res.err.Error())
+			res.metadata = map[string]string{}
+		} else if res.err != nil {
+			return item, fmt.Errorf("error reading metadata: %v", res.err)
+		}
+		metadata = applyKeyAliases(res.metadata, metadataKeyAliases(ctx))
+		item.Title = metadata["title"]
+		item.Subtitle = metadata["subtitle"]
+		item.Description = metadata["description"]
+		item.Code = metadata["code"]
+		item.Tags = parseList(metadata["tags"])
+		item.Currency = strings.ToUpper(metadata["currency"])
+		item.Status = strings.ToLower(metadata["status"])
+		item.Featured = parseBool(metadata["featured"])
+		if raw := metadata["price"]; raw != "" {
+			price, err := parsePrice(raw)
+			if err != nil {
+				// Un precio inválido no descarta el item, queda sin precio
+				loggerFrom(ctx).Warn("invalid price in metadata",
+					"folderId", folderID,
+					"folderName", folderName,
+					"error", err.Error())
+				item.Warnings = append(item.Warnings, err.Error())
+			}
+			item.Price = price
+		}
+		item.Links = parseLinks(metadata, &item)
+		item.Extra = extraMetadata(metadata)
+		item.Lang = metadataLang(metadataFileName, opts.lang)
+	}
+
+	// Validar los campos obligatorios sin descartar el item
+	for _, field := range requiredFields() {
+		if strings.TrimSpace(metadata[field]) == "" {
+			item.Warnings = append(item.Warnings, fmt.Sprintf("missing required field %q", field))
+			item.invalid = true
+		}
+	}
+
+	// Con "exclude: prueba.jpg" esas imágenes no se muestran
+	if excluded := parseList(metadata["exclude"]); len(excluded) > 0 {
+		images = excludeImages(images, excluded)
+	}
+
+	// Con "images: a.jpg, b.jpg" la galería sigue ese orden
+	if order := parseList(metadata["images"]); len(order) > 0 {
+		images = orderImages(images, order, &item)
+	}
+
+	// Recortar la galería al máximo pedido, conservando las primeras en orden natural
+	if limit := imageLimit(metadata["maximages"], opts.maxImages, &item); limit > 0 && len(images) > limit {
+		item.Warnings = append(item.Warnings, fmt.Sprintf("images truncated to %d of %d", limit, len(images)))
+		images = images[:limit]
+	}
+
+	for _, file := range images {
+		imageURL := imageURLForMode(file, opts.urlMode)
+		item.ImageURLs = append(item.ImageURLs, imageURL)
+		item.Thumbnails = append(item.Thumbnails, thumbnailURL(file, opts.thumbSize))
+		image := Image{
+			URL:      imageURL,
+			Filename: file.Name,
+			// Las claves de metadata están en minúsculas
+			Alt:       metadata["alt."+strings.ToLower(file.Name)],
+			SizeBytes: file.Size,
+		}
+		if media := file.ImageMediaMetadata; media != nil {
+			image.Width = media.Width
+			image.Height = media.Height
+			// Drive informa la rotación en cuartos de vuelta
+			image.Rotation = (media.Rotation % 4) * 90
+			image.AspectRatio = aspectRatio(media.Width, media.Height, image.Rotation)
+		}
+		item.Images = append(item.Images, image)
+	}
+	if opts.blurPreview {
+		addBlurPreviews(ctx, opts.httpClient, item.Images, images, &item)
+	}
+	// Portada: la imagen indicada en "cover" o, si no, la primera
+	if len(item.Images) > 0 {
+		item.CoverURL = item.Images[0].URL
+	}
+	if cover := metadata["cover"]; cover != "" {
+		found := false
+		for _, image := range item.Images {
+			if strings.EqualFold(image.Filename, cover) {
+				item.CoverURL = image.URL
+				found = true
+				break
+			}
+		}
+		if !found {
+			item.Warnings = append(item.Warnings, fmt.Sprintf("cover image %q not found", cover))
+		}
+	}
+
+	for _, file := range videos {
+		videoURL := videoURLForMode(file, opts.videoURLMode)
+		item.VideoURLs = append(item.VideoURLs, videoURL)
+		item.Videos = append(item.Videos, Video{URL: videoURL, ThumbnailURL: file.ThumbnailLink})
+	}
+	for _, file := range audios {
+		// Drive reproduce audios con el mismo visor que los videos
+		item.AudioURLs = append(item.AudioURLs, getVideoURL(file.Id))
+	}
+	for _, file := range documents {
+		item.Documents = append(item.Documents, getDocumentURL(file.Id))
+	}
+
+	// Sin título en la metadata, usar el nombre de la carpeta
+	if item.Title == "" {
+		item.Title = folderName
+	}
+
+	return item, nil
+}
+
+// aspectRatio calcula ancho/alto redondeado a 4 decimales, invirtiéndolo si la
+// imagen se muestra rotada 90 o 270 grados. Devuelve 0 si faltan dimensiones.
+func aspectRatio(width, height, rotation int64) float64 {
+	if width <= 0 || height <= 0 {
+		return 0
+	}
+	if rotation == 90 || rotation == 270 {
+		width, height = height, width
+	}
+	return math.Round(float64(width)/float64(height)*10000) / 10000
+}
+
+// excludeImages quita las imágenes cuyo nombre está en excluded (sin
+// distinguir mayúsculas)
+func excludeImages(images []*drive.File, excluded []string) []*drive.File {
+	var kept []*drive.File
+	for _, file := range images {
+		skip := false
+		for _, name := range excluded {
+			if strings.EqualFold(file.Name, name) {
+				skip = true
+				break
+			}
+		}
+		if !skip {
+			kept = append(kept, file)
+		}
+	}
+	return kept
+}
+
+// orderImages pone primero las imágenes nombradas en order, en ese orden, y
+// después las demás en el orden que ya tenían. Los nombres que no existen se
+// ignoran con un aviso.
+func orderImages(images []*drive.File, order []string, item *Item) []*drive.File {
+	used := make([]bool, len(images))
+	ordered := make([]*drive.File, 0, len(images))
+	for _, name := range order {
+		found := false
+		for i, file := range images {
+			if !used[i] && strings.EqualFold(file.Name, name) {
+				ordered = append(ordered, file)
+				used[i] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			item.Warnings = append(item.Warnings, fmt.Sprintf("image %q listed in images not found", name))
+		}
+	}
+	for i, file := range images {
+		if !used[i] {
+			ordered = append(ordered, file)
+		}
+	}
+	return ordered
+}
+
+// imageLimit combina el maxImages de la metadata con el de la query y devuelve
+// el menor de los dos (0 si no hay límite). Un valor inválido en la metadata
+// se ignora con un aviso.
+func imageLimit(raw string, queryLimit int, item *Item) int {
+	limit := queryLimit
+	if raw = strings.TrimSpace(raw); raw != "" {
+		value, err := strconv.Atoi(raw)
+		if err != nil || value <= 0 {
+			item.Warnings = append(item.Warnings, fmt.Sprintf("maxImages %q is not a positive integer", raw))
+		} else if limit == 0 || value < limit {
+			limit = value
+		}
+	}
+	return limit
+}
+
+// metadataResult es el resultado de descargar el archivo de metadata de un item
+type metadataResult struct {
+	metadata map[string]string
+	err      error
+}
+
+// metadataFileNames devuelve los nombres aceptados para el archivo de metadata,
+// en orden de preferencia. Se configura con METADATA_FILENAME (lista separada
+// por comas) y por defecto es metadata.txt. Cada nombre acepta también sus
+// variantes .json (preferida) y .docx. Con lang, primero se buscan las
+// versiones localizadas (ej. metadata.es.txt).
+func metadataFileNames(lang string) []string {
+	raw := os.Getenv("METADATA_FILENAME")
+	if strings.TrimSpace(raw) == "" {
+		raw = "metadata.txt"
+	}
+
+	var localized, names []string
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		ext := filepath.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		if lang != "" {
+			localized = append(localized, metadataVariants(base+"."+lang, ext)...)
+		}
+		names = append(names, metadataVariants(base, ext)...)
+	}
+	return append(localized, names...)
+}
+
+// metadataVariants arma base.json, base.yaml, base.yml, base.md, base+ext y
+// base.docx, sin repetir
+func metadataVariants(base, ext string) []string {
+	var variants []string
+	for _, structured := range []string{".json", ".yaml", ".yml", ".md"} {
+		if !strings.EqualFold(ext, structured) {
+			variants = append(variants, base+structured)
+		}
+	}
+	variants = append(variants, base+ext)
+	if !strings.EqualFold(ext, ".docx") {
+		variants = append(variants, base+".docx")
+	}
+	return variants
+}
+
+// metadataRank devuelve la prioridad del archivo como metadata (menor es mejor)
+// y false si el nombre no corresponde a un archivo de metadata. Un Google Doc
+// nativo llamado "metadata" cuenta como metadata.txt, ya que se exporta como texto.
+func metadataRank(file *drive.File, names []string) (int, bool) {
+	candidates := []string{file.Name}
+	if file.MimeType == googleDocMimeType {
+		candidates = append(candidates, file.Name+".txt")
+	}
+	for i, name := range names {
+		for _, candidate := range candidates {
+			if candidate == name {
+				return i, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// sheetMetadata es la metadata de todos los items leída de una hoja de cálculo
+type sheetMetadata struct {
+	// rows está indexada por el nombre de la carpeta en minúsculas
+	rows map[string]map[string]string
+	// modifiedTime es la última edición de la hoja, que entra en el ETag
+	modifiedTime string
+}
+
+// row devuelve una copia de la metadata de la carpeta, si la hoja la tiene
+func (m *sheetMetadata) row(folderName string) (map[string]string, bool) {
+	values, ok := m.rows[strings.ToLower(strings.TrimSpace(folderName))]
+	if !ok {
+		return nil, false
+	}
+	row := make(map[string]string, len(values))
+	for key, value := range values {
+		row[key] = value
+	}
+	return row, true
+}
+
+// loadSheetMetadata lee la hoja METADATA_SHEET_ID, o devuelve nil si no está
+// definida. La primera fila tiene las claves (title, subtitle, etc.) y cada
+// fila siguiente es un item; la carpeta se busca en la columna "folder" o, si
+// no existe, en la primera.
+func loadSheetMetadata(ctx context.Context, credentialsJSON string) (*sheetMetadata, error) {
+	sheetID := strings.TrimSpace(os.Getenv("METADATA_SHEET_ID"))
+	if sheetID == "" {
+		return nil, nil
+	}
+
+	client, err := getClient(ctx, credentialsJSON)
+	if err != nil {
+		return nil, err
+	}
+	// Sin nombre de pestaña, el rango se lee de la primera
+	values, err := withRetry(ctx, client.sheets.Spreadsheets.Values.Get(sheetID, "A:ZZ").Context(ctx).Do)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata sheet: %w", err)
+	}
+	file, err := withRetry(ctx, client.srv.Files.Get(sheetID).Fields("modifiedTime").SupportsAllDrives(true).Context(ctx).Do)
+	if err != nil {
+		return nil, fmt.Errorf("error reading metadata sheet: %w", err)
+	}
+	return &sheetMetadata{rows: parseSheetRows(values.Values), modifiedTime: file.ModifiedTime}, nil
+}
+
+// parseSheetRows arma la metadata de cada carpeta a partir de las filas de la
+// hoja. Las celdas vacías se omiten y si una carpeta se repite gana la primera.
+func parseSheetRows(rows [][]interface{}) map[string]map[string]string {
+	metadata := make(map[string]map[string]string)
+	if len(rows) == 0 {
+		return metadata
+	}
+
+	keys := make([]string, len(rows[0]))
+	folderColumn := 0
+	for i, cell := range rows[0] {
+		keys[i] = strings.ToLower(strings.TrimSpace(fmt.Sprint(cell)))
+		if keys[i] == "folder" {
+			folderColumn = i
+		}
+	}
+
+	for _, cells := range rows[1:] {
+		if folderColumn >= len(cells) {
+			continue
+		}
+		folder := strings.ToLower(strings.TrimSpace(fmt.Sprint(cells[folderColumn])))
+		if _, seen := metadata[folder]; folder == "" || seen {
+			continue
+		}
+		row := make(map[string]string)
+		for i, cell := range cells {
+			if i == folderColumn || i >= len(keys) || keys[i] == "" {
+				continue
+			}
+			if value := strings.TrimSpace(fmt.Sprint(cell)); value != "" {
+				row[keys[i]] = value
+			}
+		}
+		metadata[folder] = row
+	}
+	return metadata
+}
+
+// metadataLang devuelve el idioma de un nombre de metadata localizado
+// (metadata.es.txt -> "es"), o "" si es el archivo por defecto.
+func metadataLang(fileName, lang string) string {
+	if lang == "" {
+		return ""
+	}
+	base := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	if strings.HasSuffix(base, "."+lang) {
+		return lang
+	}
+	return ""
+}
+
+// negotiateLang elige el idioma de mayor preferencia de un header
+// Accept-Language, quedándose con el idioma principal ("es-AR" -> "es").
+// Devuelve "" si no hay ninguno válido, y se usa la metadata por defecto.
+func negotiateLang(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(params[0]))
+		tag, _, _ = strings.Cut(tag, "-")
+		if tag == "" || tag == "*" || !langPattern.MatchString(tag) {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				parsed, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err != nil {
+					parsed = 0
+				}
+				q = parsed
+			}
+		}
+		// Ante el mismo q gana el primero, como indica el header
+		if q > bestQ {
+			best, bestQ = tag, q
+		}
+	}
+	return best
+}
+
+// langPattern valida códigos de idioma como "es", "en" o "pt-br"
+var langPattern = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})?$`)
+
+// requiredFields lee REQUIRED_FIELDS: claves de metadata que cada item debe
+// tener (separadas por comas). Por defecto no hay ninguna.
+func requiredFields() []string {
+	var fields []string
+	for _, field := range parseList(os.Getenv("REQUIRED_FIELDS")) {
+		fields = append(fields, strings.ToLower(field))
+	}
+	return fields
+}
+
+// metadataKeyAliases lee METADATA_KEY_ALIASES, un objeto JSON que traduce
+// claves propias a las estándar (ej. {"name":"title","blurb":"subtitle"}).
+func metadataKeyAliases(ctx context.Context) map[string]string {
+	raw := strings.TrimSpace(os.Getenv("METADATA_KEY_ALIASES"))
+	if raw == "" {
+		return nil
+	}
+
+	var aliases map[string]string
+	if err := json.Unmarshal([]byte(raw), &aliases); err != nil {
+		loggerFrom(ctx).Warn("invalid METADATA_KEY_ALIASES", "error", err.Error())
+		return nil
+	}
+
+	// Las claves de metadata siempre se comparan en minúsculas
+	normalized := make(map[string]string, len(aliases))
+	for alias, key := range aliases {
+		normalized[strings.ToLower(strings.TrimSpace(alias))] = strings.ToLower(strings.TrimSpace(key))
+	}
+	return normalized
 }
 
-type Response struct {
-	Items []Item `json:"items"`
-	Error string `json:"error,omitempty"`
+// applyKeyAliases renombra las claves con alias. Si el archivo también trae la
+// clave estándar, esa tiene prioridad y el alias se descarta.
+func applyKeyAliases(metadata map[string]string, aliases map[string]string) map[string]string {
+	for alias, key := range aliases {
+		value, ok := metadata[alias]
+		if !ok || alias == key {
+			continue
+		}
+		delete(metadata, alias)
+		if _, exists := metadata[key]; !exists {
+			metadata[key] = value
+		}
+	}
+	return metadata
 }
 
-// Handler es la función principal que maneja las peticiones en Vercel
-func Handler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+// knownMetadataKeys son las claves que ya tienen un campo propio en Item
+var knownMetadataKeys = map[string]bool{
+	"title":       true,
+	"subtitle":    true,
+	"description": true,
+	"code":        true,
+	"tags":        true,
+	"price":       true,
+	"currency":    true,
+	"status":      true,
+	"featured":    true,
+	"cover":       true,
+	"maximages":   true,
+	"images":      true,
+	"exclude":     true,
+	"url":         true,
+	"link":        true,
+}
 
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
+// parseLinks arma los enlaces externos del item: "url" o "link" quedan como
+// "default" y "link.<nombre>" (ej. link.buy) con su nombre. Las URLs que no
+// son http(s) se descartan con un aviso.
+func parseLinks(metadata map[string]string, item *Item) map[string]string {
+	var links map[string]string
+	add := func(name, raw string) {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			return
+		}
+		if !isWebURL(raw) {
+			item.Warnings = append(item.Warnings, fmt.Sprintf("link %q is not a valid http(s) URL", raw))
+			return
+		}
+		if links == nil {
+			links = make(map[string]string)
+		}
+		links[name] = raw
 	}
 
-	if r.Method != "GET" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		json.NewEncoder(w).Encode(Response{Error: "Method not allowed"})
-		return
+	// link tiene prioridad sobre url si están los dos
+	add("default", metadata["url"])
+	add("default", metadata["link"])
+	for key, value := range metadata {
+		if name := strings.TrimPrefix(key, "link."); name != key && name != "" {
+			add(name, value)
+		}
 	}
+	return links
+}
 
-	// Obtener el ID de la carpeta raíz desde variables de entorno o query params
-	rootFolderID := r.URL.Query().Get("folderId")
-	if rootFolderID == "" {
-		rootFolderID = os.Getenv("GOOGLE_DRIVE_FOLDER_ID")
+// isWebURL indica si el texto es una URL absoluta http o https
+func isWebURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
 	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
 
-	if rootFolderID == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(Response{Error: "Folder ID is required"})
-		return
+// extraMetadata devuelve las claves de metadata sin campo propio en Item,
+// o nil si no hay ninguna.
+func extraMetadata(metadata map[string]string) map[string]string {
+	var extra map[string]string
+	for key, value := range metadata {
+		// Los textos alternativos (alt.<archivo>) van en cada imagen y los
+		// enlaces (link.<nombre>) en Links
+		if knownMetadataKeys[key] || strings.HasPrefix(key, "alt.") || strings.HasPrefix(key, "link.") {
+			continue
+		}
+		if extra == nil {
+			extra = make(map[string]string)
+		}
+		extra[key] = value
 	}
+	return extra
+}
 
-	// Obtener credenciales desde variable de entorno
-	credentialsJSON := os.Getenv("GOOGLE_CREDENTIALS_JSON")
-	if credentialsJSON == "" {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(Response{Error: "Google credentials not configured"})
-		return
+// parsePrice interpreta un precio como "49.99" o "49,99"
+func parsePrice(raw string) (float64, error) {
+	value := strings.TrimSpace(raw)
+	if !strings.Contains(value, ".") {
+		value = strings.Replace(value, ",", ".", 1)
 	}
+	price, err := strconv.ParseFloat(value, 64)
+	if err != nil || price < 0 || math.IsInf(price, 0) || math.IsNaN(price) {
+		return 0, fmt.Errorf("price %q is not a valid number", raw)
+	}
+	return price, nil
+}
 
-	ctx := context.Background()
-	srv, err := drive.NewService(ctx, option.WithCredentialsJSON([]byte(credentialsJSON)))
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(Response{Error: fmt.Sprintf("Unable to create Drive client: %v", err)})
-		return
+// parseBool interpreta "true", "yes" o "1" (sin distinguir mayúsculas) como
+// verdadero; cualquier otro valor es falso.
+func parseBool(raw string) bool {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "true", "yes", "1":
+		return true
 	}
+	return false
+}
 
-	items, err := getItems(srv, rootFolderID)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(Response{Error: err.Error()})
-		return
+// parseList separa un valor de metadata por comas, recortando espacios y
+// descartando elementos vacíos.
+func parseList(value string) []string {
+	var list []string
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			list = append(list, part)
+		}
 	}
+	return list
+}
 
-	json.NewEncoder(w).Encode(Response{Items: items})
+// extensionMimeTypes cubre las extensiones que mime.TypeByExtension puede no
+// conocer según el sistema
+var extensionMimeTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".heic": "image/heic",
+	".avif": "image/avif",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".bmp":  "image/bmp",
+	".mp4":  "video/mp4",
+	".mov":  "video/quicktime",
+	".webm": "video/webm",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".wav":  "audio/wav",
+	".ogg":  "audio/ogg",
+	".pdf":  "application/pdf",
 }
 
-func getItems(srv *drive.Service, rootFolderID string) ([]Item, error) {
-	var items []Item
+// effectiveMimeType devuelve el tipo MIME del archivo. Cuando Drive informa
+// un tipo genérico se deduce a partir de la extensión del nombre.
+func effectiveMimeType(file *drive.File) string {
+	if file.MimeType != "" && file.MimeType != "application/octet-stream" {
+		return file.MimeType
+	}
 
-	// Listar todas las carpetas dentro de la carpeta raíz
-	query := fmt.Sprintf("'%s' in parents and mimeType='application/vnd.google-apps.folder' and trashed=false", rootFolderID)
-	folderList, err := srv.Files.List().Q(query).Fields("files(id, name)").Do()
-	if err != nil {
-		return nil, fmt.Errorf("error listing folders: %v", err)
+	ext := strings.ToLower(filepath.Ext(file.Name))
+	if mimeType, ok := extensionMimeTypes[ext]; ok {
+		return mimeType
+	}
+	if mimeType := mime.TypeByExtension(ext); mimeType != "" {
+		// Quitar parámetros como "; charset=utf-8"
+		return strings.TrimSpace(strings.SplitN(mimeType, ";", 2)[0])
 	}
+	return file.MimeType
+}
 
-	// Procesar cada carpeta (cada item)
-	for _, folder := range folderList.Files {
-		item, err := processItemFolder(srv, folder.Id, folder.Name)
-		if err != nil {
-			// Log error pero continuar con los demás items
-			fmt.Printf("Error processing folder %s: %v\n", folder.Name, err)
+// resolveShortcuts reemplaza los accesos directos a imágenes, videos, audios o
+// documentos por el archivo al que apuntan, conservando el nombre del acceso
+// directo. Los que apuntan a carpetas u otros tipos se descartan, y si el
+// destino no se puede leer se avisa en los warnings del item.
+func resolveShortcuts(ctx context.Context, srv *drive.Service, files []*drive.File, item *Item) []*drive.File {
+	resolved := make([]*drive.File, len(files))
+	errs := make([]error, len(files))
+	var wg sync.WaitGroup
+	for i, file := range files {
+		if file.MimeType != shortcutMimeType {
+			resolved[i] = file
 			continue
 		}
-		items = append(items, item)
+		details := file.ShortcutDetails
+		if details == nil || !isMediaFile(&drive.File{Name: file.Name, MimeType: details.TargetMimeType}) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, shortcut *drive.File) {
+			defer wg.Done()
+			target, err := withRetry(ctx, srv.Files.Get(shortcut.ShortcutDetails.TargetId).Fields(itemFileFieldList).SupportsAllDrives(true).Context(ctx).Do)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			target.Name = shortcut.Name
+			resolved[i] = target
+		}(i, file)
 	}
+	wg.Wait()
 
-	return items, nil
+	var result []*drive.File
+	for i, file := range resolved {
+		if errs[i] != nil {
+			item.Warnings = append(item.Warnings, fmt.Sprintf("shortcut %s skipped: %v", files[i].Name, errs[i]))
+			continue
+		}
+		if file != nil {
+			result = append(result, file)
+		}
+	}
+	return result
 }
 
-func processItemFolder(srv *drive.Service, folderID, folderName string) (Item, error) {
-	item := Item{
-		ImageURLs: []string{},
-		VideoURLs: []string{},
-	}
+// isMediaFile indica si el archivo es una imagen, video, audio o documento
+func isMediaFile(file *drive.File) bool {
+	mimeType := effectiveMimeType(file)
+	return isImage(mimeType) || isVideo(mimeType) || isAudio(mimeType) || isDocument(mimeType)
+}
 
-	// Listar todos los archivos en la carpeta del item
-	query := fmt.Sprintf("'%s' in parents and trashed=false", folderID)
-	fileList, err := srv.Files.List().Q(query).Fields("files(id, name, mimeType, webContentLink, webViewLink)").Do()
-	if err != nil {
-		return item, fmt.Errorf("error listing files in folder: %v", err)
+// collectNestedImages recorre las subcarpetas (ordenadas por nombre) y
+// devuelve sus imágenes, bajando como mucho depth niveles más. visited evita
+// volver a leer una carpeta ya recorrida.
+func collectNestedImages(ctx context.Context, srv *drive.Service, folders []*drive.File, depth int, visited map[string]bool, opts itemOptions) ([]*drive.File, error) {
+	if depth < 0 {
+		return nil, nil
 	}
+	sortFilesByName(folders)
 
-	var metadataFileID string
-	var metadataFileName string
-
-	for _, file := range fileList.Files {
-		// Si es el archivo metadata.txt o metadata.docx
-		if file.Name == "metadata.txt" || file.Name == "metadata.docx" {
-			metadataFileID = file.Id
-			metadataFileName = file.Name
+	var images []*drive.File
+	for _, folder := range folders {
+		if visited[folder.Id] {
 			continue
 		}
+		visited[folder.Id] = true
 
-		// Si es una imagen
-		if isImage(file.MimeType) {
-			imageURL := getImageURL(file.Id)
-			item.ImageURLs = append(item.ImageURLs, imageURL)
+		query := fmt.Sprintf("'%s' in parents and trashed=false", folder.Id)
+		fileList, err := listFiles(ctx, srv, query, itemFileFields, opts)
+		if err != nil {
+			return nil, fmt.Errorf("error listing files in subfolder %s: %v", folder.Name, err)
 		}
 
-		// Si es un video
-		if isVideo(file.MimeType) {
-			videoURL := getVideoURL(file.Id)
-			item.VideoURLs = append(item.VideoURLs, videoURL)
+		var folderImages, subfolders []*drive.File
+		for _, file := range fileList.Files {
+			if file.MimeType == folderMimeType {
+				subfolders = append(subfolders, file)
+			} else if isImage(effectiveMimeType(file)) {
+				folderImages = append(folderImages, file)
+			}
 		}
-	}
+		sortFilesByName(folderImages)
+		images = append(images, folderImages...)
 
-	// Leer metadata.txt o metadata.docx si existe
-	if metadataFileID != "" {
-		metadata, err := readMetadata(srv, metadataFileID, metadataFileName)
+		nested, err := collectNestedImages(ctx, srv, subfolders, depth-1, visited, opts)
 		if err != nil {
-			return item, fmt.Errorf("error reading metadata: %v", err)
+			return nil, err
 		}
-		item.Title = metadata["title"]
-		item.Subtitle = metadata["subtitle"]
-		item.Description = metadata["description"]
-		item.Code = metadata["code"]
+		images = append(images, nested...)
 	}
+	return images, nil
+}
 
-	return item, nil
+// maxDepth lee MAX_DEPTH (por defecto 3): cuántos niveles de subcarpetas se
+// recorren buscando imágenes de un item. 0 desactiva la búsqueda.
+func maxDepth() int {
+	return getEnvInt("MAX_DEPTH", 3)
 }
 
 func isImage(mimeType string) bool {
@@ -169,6 +4293,8 @@ func isImage(mimeType string) bool {
 		"image/webp",
 		"image/bmp",
 	}
+	// IMAGE_MIME_TYPES agrega tipos a la lista (ej. image/heic,image/avif)
+	imageTypes = append(imageTypes, parseList(os.Getenv("IMAGE_MIME_TYPES"))...)
 	for _, t := range imageTypes {
 		if mimeType == t {
 			return true
@@ -189,6 +4315,8 @@ func isVideo(mimeType string) bool {
 		"video/3gpp",
 		"video/x-flv",
 	}
+	// VIDEO_MIME_TYPES agrega tipos a la lista (ej. video/x-matroska)
+	videoTypes = append(videoTypes, parseList(os.Getenv("VIDEO_MIME_TYPES"))...)
 	for _, t := range videoTypes {
 		if mimeType == t {
 			return true
@@ -197,6 +4325,238 @@ func isVideo(mimeType string) bool {
 	return false
 }
 
+func isAudio(mimeType string) bool {
+	audioTypes := []string{
+		"audio/mpeg",
+		"audio/mp4",
+		"audio/ogg",
+		"audio/wav",
+		"audio/webm",
+	}
+	for _, t := range audioTypes {
+		if mimeType == t {
+			return true
+		}
+	}
+	return false
+}
+
+func isDocument(mimeType string) bool {
+	return mimeType == "application/pdf"
+}
+
+// sortFilesByName ordena los archivos por nombre usando orden natural.
+func sortFilesByName(files []*drive.File) {
+	sort.SliceStable(files, func(i, j int) bool {
+		return naturalLess(files[i].Name, files[j].Name)
+	})
+}
+
+// sortFoldersStable ordena las carpetas de items por nombre en orden natural y,
+// si dos se llaman igual, por ID, para que los items salgan siempre en el
+// mismo orden aunque Drive los liste distinto.
+func sortFoldersStable(folders []*drive.File) {
+	sort.SliceStable(folders, func(i, j int) bool {
+		a, b := folders[i].Name, folders[j].Name
+		if naturalLess(a, b) || naturalLess(b, a) {
+			return naturalLess(a, b)
+		}
+		return folders[i].Id < folders[j].Id
+	})
+}
+
+// naturalLess compara dos cadenas tratando las secuencias de dígitos como
+// números, de modo que "image2.jpg" < "image10.jpg".
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			numA, restA := splitDigits(a)
+			numB, restB := splitDigits(b)
+			// Comparar sin ceros a la izquierda: primero por longitud, luego lexicográficamente
+			trimA := strings.TrimLeft(numA, "0")
+			trimB := strings.TrimLeft(numB, "0")
+			if len(trimA) != len(trimB) {
+				return len(trimA) < len(trimB)
+			}
+			if trimA != trimB {
+				return trimA < trimB
+			}
+			a, b = restA, restB
+			continue
+		}
+
+		ca := unicode.ToLower(rune(a[0]))
+		cb := unicode.ToLower(rune(b[0]))
+		if ca != cb {
+			return ca < cb
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func splitDigits(s string) (string, string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// imageURLForMode arma la URL de una imagen según urlMode. Si Drive no
+// devolvió el enlace necesario se usa la URL de visualización.
+func imageURLForMode(file *drive.File, urlMode string) string {
+	switch urlMode {
+	case "thumbnail":
+		if file.ThumbnailLink != "" {
+			return resizeThumbnailLink(file.ThumbnailLink, largeThumbnailSize)
+		}
+	case "download":
+		if file.WebContentLink != "" {
+			return file.WebContentLink
+		}
+	default:
+		// En archivos grandes uc?export=view muestra el aviso de Drive de que
+		// no pudo analizarlos en busca de virus en lugar de la imagen
+		if file.WebContentLink != "" && file.Size > largeFileBytes() {
+			return file.WebContentLink
+		}
+	}
+	return getImageURL(file.Id)
+}
+
+// largeFileBytes lee LARGE_FILE_BYTES (por defecto 25 MB): a partir de ese
+// tamaño las imágenes usan webContentLink en vez de la URL de visualización.
+func largeFileBytes() int64 {
+	n := getEnvInt("LARGE_FILE_BYTES", 25<<20)
+	if n < 1 {
+		n = 25 << 20
+	}
+	return int64(n)
+}
+
+// videoURLForMode arma la URL de un video según videoUrlMode: el reproductor
+// de Drive o, en modo download, un enlace directo al archivo para
+// reproductores nativos.
+func videoURLForMode(file *drive.File, videoURLMode string) string {
+	if videoURLMode != "download" {
+		return getVideoURL(file.Id)
+	}
+	if file.WebContentLink != "" {
+		return file.WebContentLink
+	}
+	return getDocumentURL(file.Id)
+}
+
+// thumbnailURL devuelve la miniatura de la imagen con el tamaño pedido, o la
+// URL de visualización si Drive no generó miniatura.
+func thumbnailURL(file *drive.File, size int) string {
+	if file.ThumbnailLink == "" {
+		return getImageURL(file.Id)
+	}
+	return resizeThumbnailLink(file.ThumbnailLink, size)
+}
+
+// defaultThumbnailSize y maxThumbnailSize acotan el parámetro thumbSize
+const (
+	defaultThumbnailSize = 400
+	maxThumbnailSize     = 4096
+)
+
+// largeThumbnailSize es el lado mayor, en píxeles, de las imágenes en urlMode=thumbnail
+const largeThumbnailSize = 1600
+
+// blurPreviewSize es el lado mayor, en píxeles, de las miniaturas de blurPreview
+const blurPreviewSize = 16
+
+// blurPreviewMaxBytes acota lo que se lee de cada miniatura de blurPreview
+const blurPreviewMaxBytes = 16 << 10
+
+// blurPreviewTimeout acota cuánto puede tardar cada miniatura de blurPreview
+const blurPreviewTimeout = 5 * time.Second
+
+// blurPreviewConcurrency limita cuántas miniaturas de un item se descargan a
+// la vez; los items ya se procesan de a CONCURRENCY en paralelo
+const blurPreviewConcurrency = 4
+
+// addBlurPreviews completa BlurDataURL de cada imagen descargando en paralelo
+// su miniatura diminuta con el cliente autenticado del Service Account, ya
+// que los thumbnailLink de archivos privados piden credenciales. Si alguna
+// falla la imagen queda sin vista previa y se avisa en los warnings del item.
+func addBlurPreviews(ctx context.Context, client *http.Client, images []Image, files []*drive.File, item *Item) {
+	errs := make([]error, len(images))
+	sem := make(chan struct{}, blurPreviewConcurrency)
+	var wg sync.WaitGroup
+	for i, file := range files {
+		if file.ThumbnailLink == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, link string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			images[i].BlurDataURL, errs[i] = fetchBlurDataURL(ctx, client, resizeThumbnailLink(link, blurPreviewSize))
+		}(i, file.ThumbnailLink)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			item.Warnings = append(item.Warnings, fmt.Sprintf("blur preview for %s skipped: %v", images[i].Filename, err))
+		}
+	}
+}
+
+// fetchBlurDataURL descarga una miniatura y la devuelve como data URI en base64
+func fetchBlurDataURL(ctx context.Context, client *http.Client, link string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, blurPreviewTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("thumbnail returned status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, blurPreviewMaxBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > blurPreviewMaxBytes {
+		return "", fmt.Errorf("thumbnail larger than %d bytes", blurPreviewMaxBytes)
+	}
+
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !strings.HasPrefix(contentType, "image/") {
+		contentType = http.DetectContentType(data)
+	}
+	return "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// thumbnailSizePattern reconoce el sufijo de tamaño de los thumbnailLink (ej. "=s220")
+var thumbnailSizePattern = regexp.MustCompile(`=s\d+(-[a-z0-9-]+)?$`)
+
+// resizeThumbnailLink cambia el tamaño pedido en un thumbnailLink de Drive
+func resizeThumbnailLink(link string, size int) string {
+	suffix := fmt.Sprintf("=s%d", size)
+	if thumbnailSizePattern.MatchString(link) {
+		return thumbnailSizePattern.ReplaceAllString(link, suffix)
+	}
+	return link + suffix
+}
+
 func getImageURL(fileID string) string {
 	// URL pública para ver/descargar la imagen
 	return fmt.Sprintf("https://drive.google.com/uc?export=view&id=%s", fileID)
@@ -207,61 +4567,366 @@ func getVideoURL(fileID string) string {
 	return fmt.Sprintf("https://drive.google.com/file/d/%s/preview", fileID)
 }
 
-func readMetadata(srv *drive.Service, fileID, fileName string) (map[string]string, error) {
-	resp, err := srv.Files.Get(fileID).Download()
+func getDocumentURL(fileID string) string {
+	// URL de descarga directa del documento
+	return fmt.Sprintf("https://drive.google.com/uc?export=download&id=%s", fileID)
+}
+
+// errMetadataTooLarge indica que el archivo de metadata supera METADATA_MAX_BYTES
+var errMetadataTooLarge = errors.New("metadata file exceeds the size limit")
+
+// metadataMaxBytes lee METADATA_MAX_BYTES (por defecto 1 MB): tamaño máximo
+// que se lee de un archivo de metadata.
+func metadataMaxBytes() int64 {
+	n := getEnvInt("METADATA_MAX_BYTES", 1<<20)
+	if n < 1 {
+		n = 1 << 20
+	}
+	return int64(n)
+}
+
+// metadataTimeout lee METADATA_TIMEOUT_SECONDS (por defecto 10): tiempo máximo
+// para descargar un archivo de metadata.
+func metadataTimeout() time.Duration {
+	seconds := getEnvInt("METADATA_TIMEOUT_SECONDS", 10)
+	if seconds < 1 {
+		seconds = 10
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func readMetadata(ctx context.Context, srv *drive.Service, fileID, fileName, mimeType string) (metadata map[string]string, err error) {
+	ctx, span := tracer.Start(ctx, "drive.Files.Download", trace.WithAttributes(
+		attribute.String("drive.file_id", fileID),
+		attribute.String("drive.file_name", fileName)))
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, metadataTimeout())
+	defer cancel()
+
+	var resp *http.Response
+	if mimeType == googleDocMimeType {
+		// Los Google Docs nativos no se pueden descargar, se exportan como texto
+		resp, err = withRetry(ctx, srv.Files.Export(fileID, "text/plain").Context(ctx).Download)
+	} else {
+		resp, err = withRetry(ctx, srv.Files.Get(fileID).SupportsAllDrives(true).Context(ctx).Download)
+	}
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	// Leer un byte más que el máximo para saber si el archivo lo supera
+	maxBytes := metadataMaxBytes()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
 	if err != nil {
 		return nil, err
 	}
+	if int64(len(body)) > maxBytes {
+		return nil, fmt.Errorf("%w (%d bytes)", errMetadataTooLarge, maxBytes)
+	}
+
+	if mimeType == googleDocMimeType {
+		// La exportación comienza con un BOM UTF-8
+		return parseMetadata(strings.TrimPrefix(string(body), "\ufeff"), metadataKeyAliases(ctx)), nil
+	}
+
+	// Si es un archivo .json, los valores se toman tal cual (pueden contener ":")
+	if strings.HasSuffix(strings.ToLower(fileName), ".json") {
+		return parseJSONMetadata(body)
+	}
+
+	// Si es un archivo YAML, se aceptan listas y bloques de texto de varias líneas
+	if lower := strings.ToLower(fileName); strings.HasSuffix(lower, ".yaml") || strings.HasSuffix(lower, ".yml") {
+		return parseYAMLMetadata(string(body))
+	}
+
+	// Si es markdown, el front matter es YAML y el cuerpo es la descripción
+	if strings.HasSuffix(strings.ToLower(fileName), ".md") {
+		return parseMarkdownMetadata(string(body))
+	}
 
-	var content string
-	
-	// Si es un archivo .docx, usar pandoc para extraer el texto
+	// Si es un archivo .docx, extraer el texto del documento
 	if strings.HasSuffix(strings.ToLower(fileName), ".docx") {
-		// Guardar temporalmente el archivo
-		tmpFile := fmt.Sprintf("/tmp/metadata_%s.docx", fileID)
-		if err := os.WriteFile(tmpFile, body, 0644); err != nil {
-			return nil, fmt.Errorf("error writing temp file: %v", err)
+		text, err := extractDocxText(body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading docx: %v", err)
+		}
+		return parseMetadata(text, metadataKeyAliases(ctx)), nil
+	}
+
+	// Es un archivo .txt
+	return parseMetadata(string(body), metadataKeyAliases(ctx)), nil
+}
+
+// extractDocxText obtiene el texto de un .docx sin herramientas externas: lee
+// word/document.xml del zip en memoria y concatena los textos (w:t) de cada
+// párrafo, terminando cada párrafo (w:p) en un salto de línea.
+func extractDocxText(body []byte) (string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return "", err
+	}
+
+	for _, f := range archive.File {
+		if f.Name != "word/document.xml" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
 		}
-		defer os.Remove(tmpFile)
+		defer rc.Close()
+
+		return docxDocumentText(rc)
+	}
+	return "", fmt.Errorf("word/document.xml not found")
+}
+
+// docxDocumentText recorre el XML de WordprocessingML juntando el texto
+func docxDocumentText(r io.Reader) (string, error) {
+	const wordNamespace = "http://schemas.openxmlformats.org/wordprocessingml/2006/main"
+
+	var text strings.Builder
+	decoder := xml.NewDecoder(r)
+	inText := false
 
-		// Usar pandoc para extraer texto
-		cmd := exec.Command("pandoc", tmpFile, "-t", "plain")
-		output, err := cmd.Output()
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			return nil, fmt.Errorf("error running pandoc: %v", err)
+			return "", err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if t.Name.Space != wordNamespace {
+				continue
+			}
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				text.WriteString("\t")
+			case "br", "cr":
+				text.WriteString("\n")
+			}
+		case xml.EndElement:
+			if t.Name.Space != wordNamespace {
+				continue
+			}
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				text.WriteString("\n")
+			}
+		case xml.CharData:
+			if inText {
+				text.Write(t)
+			}
 		}
-		content = string(output)
-	} else {
-		// Es un archivo .txt
-		content = string(body)
 	}
 
-	return parseMetadata(content), nil
+	return text.String(), nil
 }
 
-func parseMetadata(content string) map[string]string {
+// parseMetadata lee líneas "clave: valor". La descripción puede ocupar varias
+// líneas: las que siguen a "description:" se agregan a su valor, separadas por
+// saltos de línea, hasta la próxima clave reconocida (ver isRecognizedKey).
+// Así una línea de la descripción con dos puntos o una URL no la corta.
+// aliases son las claves de METADATA_KEY_ALIASES, que también se reconocen.
+func parseMetadata(content string, aliases map[string]string) map[string]string {
 	metadata := make(map[string]string)
-	lines := strings.Split(content, "\n")
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	inDescription := false
 
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
-		if line == "" {
+
+		key, value, isKey := splitMetadataLine(line)
+		if isKey && inDescription && !isRecognizedKey(key, aliases) {
+			isKey = false
+		}
+		if isKey {
+			metadata[key] = value
+			inDescription = key == "description"
 			continue
 		}
 
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) == 2 {
-			key := strings.ToLower(strings.TrimSpace(parts[0]))
-			value := strings.TrimSpace(parts[1])
-			metadata[key] = value
+		if inDescription {
+			if metadata["description"] == "" {
+				metadata["description"] = line
+			} else {
+				metadata["description"] += "\n" + line
+			}
 		}
 	}
 
+	if description, ok := metadata["description"]; ok {
+		metadata["description"] = strings.TrimSpace(description)
+	}
+
 	return metadata
 }
+
+// splitMetadataLine separa una línea "clave: valor". La clave es todo lo que
+// está antes de los primeros dos puntos, sin espacios alrededor y en
+// minúsculas; puede contener espacios (por ejemplo "Fecha de creacion"). Los
+// dos puntos de una URL ("https://...") no separan una clave.
+func splitMetadataLine(line string) (string, string, bool) {
+	parts := strings.SplitN(line, ":", 2)
+	if len(parts) != 2 || strings.HasPrefix(parts[1], "//") {
+		return "", "", false
+	}
+
+	key := strings.ToLower(strings.TrimSpace(parts[0]))
+	if key == "" {
+		return "", "", false
+	}
+	return key, strings.TrimSpace(parts[1]), true
+}
+
+// isRecognizedKey indica si la clave termina una descripción de varias
+// líneas: las que tienen campo propio en Item, las alt.<archivo> y
+// link.<nombre>, y las de METADATA_KEY_ALIASES.
+func isRecognizedKey(key string, aliases map[string]string) bool {
+	if knownMetadataKeys[key] || strings.HasPrefix(key, "alt.") || strings.HasPrefix(key, "link.") {
+		return true
+	}
+	_, ok := aliases[key]
+	return ok
+}
+
+// parseJSONMetadata convierte un objeto JSON al mismo mapa que parseMetadata.
+// Las listas se unen con comas (por ejemplo tags) y los números o booleanos
+// se convierten a texto.
+func parseJSONMetadata(body []byte) (map[string]string, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, fmt.Errorf("invalid metadata JSON: %v", err)
+	}
+
+	metadata := make(map[string]string)
+	for key, value := range raw {
+		key = strings.ToLower(strings.TrimSpace(key))
+		switch v := value.(type) {
+		case nil:
+			continue
+		case string:
+			metadata[key] = v
+		case []interface{}:
+			parts := make([]string, 0, len(v))
+			for _, elem := range v {
+				parts = append(parts, fmt.Sprint(elem))
+			}
+			metadata[key] = strings.Join(parts, ", ")
+		case map[string]interface{}:
+			encoded, _ := json.Marshal(v)
+			metadata[key] = string(encoded)
+		default:
+			metadata[key] = fmt.Sprint(v)
+		}
+	}
+	return metadata, nil
+}
+
+// parseYAMLMetadata lee un metadata.yaml y devuelve el mismo mapa que
+// parseMetadata: las listas se unen con comas, los valores nulos quedan vacíos
+// y las claves anidadas se aplanan con puntos ("alt: {a.jpg: ...}" ->
+// "alt.a.jpg"). Los valores se toman como texto tal cual están escritos, así
+// un código como 007 no se convierte en el número 7.
+func parseYAMLMetadata(content string) (map[string]string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(content), &doc); err != nil {
+		return nil, fmt.Errorf("invalid metadata YAML: %v", err)
+	}
+
+	metadata := make(map[string]string)
+	if len(doc.Content) == 0 {
+		return metadata, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("invalid metadata YAML: expected \"key: value\" lines")
+	}
+	flattenYAMLMapping(root, "", metadata)
+	return metadata, nil
+}
+
+// flattenYAMLMapping agrega a out las claves del mapa, en minúsculas y con el
+// prefijo de las claves que lo contienen
+func flattenYAMLMapping(node *yaml.Node, prefix string, out map[string]string) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := prefix + strings.ToLower(strings.TrimSpace(node.Content[i].Value))
+		value := resolveYAMLAlias(node.Content[i+1])
+		switch value.Kind {
+		case yaml.MappingNode:
+			flattenYAMLMapping(value, key+".", out)
+		case yaml.SequenceNode:
+			var list []string
+			for _, elem := range value.Content {
+				if text := yamlScalarText(resolveYAMLAlias(elem)); text != "" {
+					list = append(list, text)
+				}
+			}
+			out[key] = strings.Join(list, ", ")
+		default:
+			out[key] = yamlScalarText(value)
+		}
+	}
+}
+
+// resolveYAMLAlias devuelve el nodo al que apunta un alias (*ancla)
+func resolveYAMLAlias(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	return node
+}
+
+// yamlScalarText devuelve el texto de un valor simple; los nulos y los
+// valores que no son simples quedan vacíos
+func yamlScalarText(node *yaml.Node) string {
+	if node.Kind != yaml.ScalarNode || node.Tag == "!!null" {
+		return ""
+	}
+	return strings.TrimSpace(node.Value)
+}
+
+// parseMarkdownMetadata lee un markdown con front matter YAML entre líneas
+// "---". Las claves del front matter se leen como en metadata.yaml y el cuerpo,
+// si tiene texto, reemplaza a la descripción.
+func parseMarkdownMetadata(content string) (map[string]string, error) {
+	content = strings.TrimPrefix(strings.ReplaceAll(content, "\r\n", "\n"), "\ufeff")
+
+	metadata := map[string]string{}
+	body := content
+	lines := strings.Split(content, "\n")
+	if strings.TrimSpace(lines[0]) == "---" {
+		end := -1
+		for i := 1; i < len(lines); i++ {
+			if trimmed := strings.TrimSpace(lines[i]); trimmed == "---" || trimmed == "..." {
+				end = i
+				break
+			}
+		}
+		if end == -1 {
+			return nil, fmt.Errorf("invalid metadata markdown: front matter is not closed")
+		}
+
+		var err error
+		metadata, err = parseYAMLMetadata(strings.Join(lines[1:end], "\n"))
+		if err != nil {
+			return nil, err
+		}
+		body = strings.Join(lines[end+1:], "\n")
+	}
+
+	if description := strings.TrimSpace(body); description != "" {
+		metadata["description"] = description
+	}
+	return metadata, nil
+}